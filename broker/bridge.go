@@ -11,11 +11,15 @@ var (
 	log = logger.Instance.Named("broker")
 )
 
-func (b *Broker) Publish(e *bridge.Elements) {
+// Publish sends e to the bridge, an error means a write the rules want
+// confirmed failed
+func (b *Broker) Publish(e *bridge.Elements) error {
 	if bridge.Delivers.ExistTargets() {
 		err := b.bridgeMQ.Publish(e)
 		if err != nil {
 			log.Error("send message to mq error.", zap.Error(err))
+			return err
 		}
 	}
+	return nil
 }
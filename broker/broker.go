@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"path/filepath"
 	"rocketmqtt/conf"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 
 	"rocketmqtt/plugins/auth"
 
+	"rocketmqtt/broker/lib/mqtt5"
 	"rocketmqtt/broker/lib/sessions"
 	"rocketmqtt/broker/lib/topics"
 
@@ -32,6 +34,8 @@ const (
 type Message struct {
 	client *client
 	packet packets.ControlPacket
+	// ext is the MQTT 5 part of packet, nil for 3.1.1
+	ext *mqtt5.Ext
 }
 
 type Broker struct {
@@ -43,6 +47,8 @@ type Broker struct {
 	clients   sync.Map
 	routes    sync.Map
 	remotes   sync.Map
+	offline   sync.Map // disconnected clients of persistent sessions
+	owners    sync.Map // client id -> route of the node the client is on
 	nodes     map[string]interface{}
 	// clusterPool  chan *Message
 	topicsMgr    *topics.Manager
@@ -51,6 +57,9 @@ type Broker struct {
 	bridgeMQ     bridge.BridgeMQ
 	elementsPool sync.Pool
 	msgsPool     sync.Pool
+	shareGroups  *shareGroups
+	clock        clusterClock
+	forwardAcks  sync.Map // ack id -> *forwardAck of the downlinks forwarded to another node
 }
 
 // func newMessagePool() []chan *Message {
@@ -68,17 +77,18 @@ func NewBroker(config *conf.Config) (*Broker, error) {
 		wpool: pool.New(config.Broker.WorkerNum),
 		nodes: make(map[string]interface{}),
 		//clusterPool: make(chan *Message),
-		config: config,
+		config:      config,
+		shareGroups: newShareGroups(),
 	}
 
 	var err error
-	b.topicsMgr, err = topics.NewManager("mem")
+	b.topicsMgr, err = newTopicsManager(config.Store)
 	if err != nil {
 		log.Error("new topic manager error", zap.Error(err))
 		return nil, err
 	}
 
-	b.sessionMgr, err = sessions.NewManager("mem")
+	b.sessionMgr, err = newSessionManager(config.Store)
 	if err != nil {
 		log.Error("new session manager error", zap.Error(err))
 		return nil, err
@@ -110,6 +120,33 @@ func NewBroker(config *conf.Config) (*Broker, error) {
 	return b, nil
 }
 
+func newTopicsManager(store conf.Store) (*topics.Manager, error) {
+	switch store.Topics {
+	case "", "mem":
+		return topics.NewManager("mem")
+	case "bolt":
+		p, err := topics.NewBoltProvider(filepath.Join(store.DataDir(), "retained.db"))
+		if err != nil {
+			return nil, err
+		}
+		topics.Register("bolt", p)
+		return topics.NewManager("bolt")
+	}
+	return topics.NewManager(store.Topics)
+}
+
+func (b *Broker) topicAliasMaximum() uint16 {
+	return b.config.Broker.TopicAliasMaximum
+}
+
+// writeConnack writes connack as MQTT 5 when ext is set, as 3.1.1 otherwise.
+func writeConnack(conn net.Conn, connack *packets.ConnackPacket, ext *mqtt5.Ext) error {
+	if ext != nil {
+		return mqtt5.WritePacket(conn, connack, ext)
+	}
+	return connack.Write(conn)
+}
+
 func (b *Broker) SubmitWork(clientId string, msg *Message) {
 	if b.wpool == nil {
 		b.wpool = pool.New(b.config.Broker.WorkerNum)
@@ -134,15 +171,22 @@ func (b *Broker) Start() {
 		go InitHTTPMoniter(b)
 	}
 
+	//sessions stored by the last run, before any client or peer connects
+	b.restoreSessions()
+
+	//resend unacked qos 1/2 messages
+	go b.StartRetry()
+
 	//listen client over tcp
 	if b.config.Listen.Port != "" {
 		go b.StartClientListening(false)
 	}
 
 	//listen for cluster
-	//if b.config.Cluster.Port != "" {
-	//	go b.StartClusterListening()
-	//}
+	if b.config.Cluster.Port != "" {
+		go b.StartClusterListening()
+		b.ConnectToPeers()
+	}
 
 	//listen for websocket
 	if b.config.Listen.WebsocketPort != "" {
@@ -162,6 +206,17 @@ func (b *Broker) Start() {
 
 }
 
+// Close closes the topics and sessions stores on shutdown, so the retained
+// messages not written yet reach the disk.
+func (b *Broker) Close() {
+	if err := b.topicsMgr.Close(); err != nil {
+		log.Error("close topics store error", zap.Error(err))
+	}
+	if err := b.sessionMgr.Close(); err != nil {
+		log.Error("close sessions store error", zap.Error(err))
+	}
+}
+
 func (b *Broker) StartWebsocketListening() {
 	path := b.config.Listen.WebsocketPath
 	hp := ":" + b.config.Listen.WebsocketPort
@@ -230,45 +285,12 @@ func (b *Broker) StartClientListening(Tls bool) {
 	}
 }
 
-//func (b *Broker) StartClusterListening() {
-//	var hp string = b.config.Cluster.Host + ":" + b.config.Cluster.Port
-//	log.Info("Start Listening cluster on ", zap.String("hp", hp))
-//
-//	l, e := net.Listen("tcp", hp)
-//	if e != nil {
-//		log.Error("Error listening on ", zap.Error(e))
-//		return
-//	}
-//
-//	tmpDelay := 10 * ACCEPT_MIN_SLEEP
-//	for {
-//		conn, err := l.Accept()
-//		if err != nil {
-//			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-//				log.Error("Temporary Client Accept Error(%v), sleeping %dms",
-//					zap.Error(ne), zap.Duration("sleeping", tmpDelay/time.Millisecond))
-//				time.Sleep(tmpDelay)
-//				tmpDelay *= 2
-//				if tmpDelay > ACCEPT_MAX_SLEEP {
-//					tmpDelay = ACCEPT_MAX_SLEEP
-//				}
-//			} else {
-//				log.Error("Accept error: %v", zap.Error(err))
-//			}
-//			continue
-//		}
-//		tmpDelay = ACCEPT_MIN_SLEEP
-//
-//		go b.handleConnection(ROUTER, conn)
-//	}
-//}
-
 func (b *Broker) handleConnection(typ int, conn net.Conn) {
 
 	CountIncrease(&ClientCount)
 
-	//process connect packet
-	packet, err := packets.ReadPacket(conn)
+	//process connect packet, of any protocol level
+	packet, ext, err := mqtt5.ReadPacket(conn, 0)
 	if err != nil {
 		log.Error("read connect packet error: ", zap.Error(err))
 		return
@@ -285,17 +307,29 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 
 	log.Debug("new connect from ", zap.String("clientID", msg.ClientIdentifier))
 
-	// disconnect without client id
+	//MQTT 5 properties of the connack, nil for a 3.1.1 client
+	var ackExt *mqtt5.Ext
+	if msg.ProtocolVersion == mqtt5.Version5 {
+		ackExt = &mqtt5.Ext{}
+	}
+
 	if msg.ClientIdentifier == "" {
-		conn.Close()
+		if ackExt != nil {
+			// a MQTT 5 client is given an id
+			msg.ClientIdentifier = GenUniqueId()
+			ackExt.Properties.AssignedClientID = msg.ClientIdentifier
+		} else {
+			// disconnect without client id
+			conn.Close()
+		}
 	}
 
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = msg.CleanSession
-	connack.ReturnCode = msg.Validate()
+	connack.SessionPresent = false
+	connack.ReturnCode = mqtt5.Validate(msg)
 
 	if connack.ReturnCode != packets.Accepted {
-		err = connack.Write(conn)
+		err = writeConnack(conn, connack, ackExt)
 		if err != nil {
 			log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
 			return
@@ -305,7 +339,7 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 
 	if typ == CLIENT && !b.CheckConnectAuth(string(msg.ClientIdentifier), string(msg.Username), string(msg.Password)) {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
-		err = connack.Write(conn)
+		err = writeConnack(conn, connack, ackExt)
 		if err != nil {
 			log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
 			return
@@ -313,12 +347,6 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		return
 	}
 
-	err = connack.Write(conn)
-	if err != nil {
-		log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
-		return
-	}
-
 	willmsg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	if msg.WillFlag {
 		willmsg.Qos = msg.WillQos
@@ -330,33 +358,46 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		willmsg = nil
 	}
 	info := info{
-		clientID:  msg.ClientIdentifier,
-		username:  msg.Username,
-		password:  msg.Password,
-		keepalive: msg.Keepalive,
-		willMsg:   willmsg,
+		clientID:     msg.ClientIdentifier,
+		username:     msg.Username,
+		password:     msg.Password,
+		keepalive:    msg.Keepalive,
+		cleanSession: msg.CleanSession,
+		willMsg:      willmsg,
+		connectedAt:  b.clock.now(),
+	}
+	if ext != nil {
+		//a MQTT 5 session outlives the connection only with a session expiry interval
+		info.cleanSession = true
+		if e := ext.Properties.SessionExpiry; e != nil && *e > 0 {
+			info.sessionExpiry = *e
+			info.cleanSession = false
+		}
+		if rm := ext.Properties.ReceiveMaximum; rm != nil {
+			info.receiveMaximum = *rm
+		}
+		if willmsg != nil {
+			info.willProps = ext.WillProperties.Forward()
+		}
 	}
 
 	c := &client{
-		typ:    typ,
-		broker: b,
-		conn:   conn,
-		info:   info,
+		typ:     typ,
+		broker:  b,
+		conn:    conn,
+		info:    info,
+		version: msg.ProtocolVersion,
 	}
 
 	c.init()
 
-	err = b.getSession(c, msg, connack)
-	if err != nil {
-		log.Error("get session error: ", zap.String("clientID", c.info.clientID))
-		return
-	}
-
 	cid := c.info.clientID
 
 	var exist bool
 	var old interface{}
 
+	// the old connection is closed before looking up the session, so a clean
+	// session it held is discarded and a persistent one is left offline
 	switch typ {
 	case CLIENT:
 		old, exist = b.clients.Load(cid)
@@ -364,20 +405,11 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 			log.Warn("client exist, close old...", zap.String("clientID", c.info.clientID))
 			ol, ok := old.(*client)
 			if ok {
-				ol.Close()
+				ol.Disconnect(mqtt5.SessionTakenOver)
 			}
 		}
-		b.clients.Store(cid, c)
-
-		//b.OnlineOfflineNotification(cid, true)
-		//{
-		//	b.Publish(&bridge.Elements{
-		//		ClientID:  string(msg.ClientIdentifier),
-		//		Username:  string(msg.Username),
-		//		Action:    bridge.Connect,
-		//		Timestamp: time.Now().UnixNano(),
-		//	})
-		//}
+		//the client may still be connected to another node
+		b.BroadcastTakeover(c)
 	case ROUTER:
 		old, exist = b.routes.Load(cid)
 		if exist {
@@ -387,6 +419,54 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 				ol.Close()
 			}
 		}
+	}
+
+	//take over the previous connection of a persistent session before its
+	//session may expire
+	off, offline := b.takeOffline(cid)
+
+	err = b.getSession(c, msg, connack)
+	if err != nil {
+		log.Error("get session error: ", zap.String("clientID", c.info.clientID))
+		return
+	}
+
+	//subscriptions left by the previous connection of a persistent session,
+	//when the session is resumed they are subscribed again from the session
+	if offline {
+		off.unsubscribeLocal()
+		if !connack.SessionPresent {
+			b.BroadcastUnSubscribe(off.subMap)
+		}
+	}
+
+	if ackExt != nil {
+		if n := b.topicAliasMaximum(); n > 0 {
+			ackExt.Properties.TopicAliasMaximum = mqtt5.Uint16(n)
+		}
+		// subscription identifiers are not kept with the subscriptions
+		ackExt.Properties.SubIDAvailable = mqtt5.Byte(0)
+	}
+	err = writeConnack(conn, connack, ackExt)
+	if err != nil {
+		log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
+		return
+	}
+
+	switch typ {
+	case CLIENT:
+		b.clients.Store(cid, c)
+
+		//resume the subscriptions and the outbound window of a persistent session
+		if connack.SessionPresent {
+			c.restoreSubscriptions()
+			c.resendInflight(0)
+			c.sendQueued()
+		}
+
+		//b.OnlineOfflineNotification(cid, true)
+		c.publishEvent(bridge.Connect, "", 0)
+	case ROUTER:
 		b.routes.Store(cid, c)
 	}
 	c.readLoop()
@@ -456,10 +536,10 @@ func (b *Broker) connectRouter(id, addr string) {
 	var conn net.Conn
 	var err error
 	var timeDelay time.Duration = 0
-	retryTimes := 0
 	max := 32 * time.Second
 	for {
 
+		//retry as long as the node is part of the cluster
 		if !b.checkNodeExist(id, addr) {
 			return
 		}
@@ -468,10 +548,6 @@ func (b *Broker) connectRouter(id, addr string) {
 		if err != nil {
 			log.Error("Error trying to connect to route: ", zap.Error(err))
 
-			if retryTimes > 50 {
-				return
-			}
-
 			log.Debug("Connect to route timeout ,retry...")
 
 			if timeDelay == 0 {
@@ -484,7 +560,6 @@ func (b *Broker) connectRouter(id, addr string) {
 				timeDelay = max
 			}
 			time.Sleep(timeDelay)
-			retryTimes++
 			continue
 		}
 		break
@@ -501,16 +576,19 @@ func (b *Broker) connectRouter(id, addr string) {
 	}
 
 	c := &client{
-		broker: b,
-		typ:    REMOTE,
-		conn:   conn,
-		route:  route,
-		info:   info,
+		broker:  b,
+		typ:     REMOTE,
+		conn:    conn,
+		route:   route,
+		info:    info,
+		version: mqtt5.Version5,
 	}
 	c.init()
 	b.remotes.Store(cid, c)
 
 	c.SendConnect()
+	b.SendLocalSubsToRouter(c)
+	b.SendLocalClientsToRouter(c)
 
 	// mpool := b.messagePool[fnv1a.HashString64(cid)%MessagePoolNum]
 	go c.readLoop()
@@ -556,27 +634,6 @@ func (b *Broker) CheckRemoteExist(remoteID, url string) bool {
 	return exist
 }
 
-func (b *Broker) SendLocalSubsToRouter(c *client) {
-	subInfo := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	b.clients.Range(func(key, value interface{}) bool {
-		client, ok := value.(*client)
-		if ok {
-			subs := client.subMap
-			for _, sub := range subs {
-				subInfo.Topics = append(subInfo.Topics, sub.topic)
-				subInfo.Qoss = append(subInfo.Qoss, sub.qos)
-			}
-		}
-		return true
-	})
-	if len(subInfo.Topics) > 0 {
-		err := c.WriterPacket(subInfo)
-		if err != nil {
-			log.Error("Send localsubs To Router error :", zap.Error(err))
-		}
-	}
-}
-
 func (b *Broker) BroadcastInfoMessage(remoteID string, msg *packets.PublishPacket) {
 	b.routes.Range(func(key, value interface{}) bool {
 		r, ok := value.(*client)
@@ -592,9 +649,11 @@ func (b *Broker) BroadcastInfoMessage(remoteID string, msg *packets.PublishPacke
 	// log.Info("BroadcastInfoMessage success ")
 }
 
+// BroadcastSubOrUnsubMessage sends a subscription change of a local client to
+// every peer, over the routes this node dialed.
 func (b *Broker) BroadcastSubOrUnsubMessage(packet packets.ControlPacket) {
 
-	b.routes.Range(func(key, value interface{}) bool {
+	b.remotes.Range(func(key, value interface{}) bool {
 		r, ok := value.(*client)
 		if ok {
 			r.WriterPacket(packet)
@@ -612,6 +671,7 @@ func (b *Broker) removeClient(c *client) {
 		b.clients.Delete(clientId)
 	case ROUTER:
 		b.routes.Delete(clientId)
+		b.dropOwners(c)
 	case REMOTE:
 		b.remotes.Delete(clientId)
 	}
@@ -619,6 +679,10 @@ func (b *Broker) removeClient(c *client) {
 }
 
 func (b *Broker) PublishMessage(packet *packets.PublishPacket) {
+	b.publishMessage(packet, nil)
+}
+
+func (b *Broker) publishMessage(packet *packets.PublishPacket, props *mqtt5.Properties) {
 	var subs []interface{}
 	var qoss []byte
 	b.mu.Lock()
@@ -629,32 +693,64 @@ func (b *Broker) PublishMessage(packet *packets.PublishPacket) {
 		return
 	}
 
-	for _, sub := range subs {
-		s, ok := sub.(*subscription)
-		if ok {
-			err := s.client.WriterPacket(packet)
-			if err != nil {
-				log.Error("write message error,  ", zap.Error(err))
-			}
-		}
-	}
+	b.dispatch(subs, packet, props, "", true, nil)
 }
 
 // send message by cid, not by subscribe, skip search subscribers
-func (b *Broker) PublishMessageByCid(cid string, packet *packets.PublishPacket) {
-	c, exist := b.clients.Load(cid)
-	if exist {
-		cl, ok := c.(*client)
-		var err error
-		if ok {
-			err = cl.WriterPacket(packet)
+// PublishMessageByCid sends packet to client cid, on this node or on the
+// node of the cluster it is connected to. An error means no node has the
+// client, the message is left for the caller to retry.
+func (b *Broker) PublishMessageByCid(cid string, packet *packets.PublishPacket) error {
+	_, err := b.PublishMessageByCidAcked(cid, packet, nil, nil)
+	return err
+}
+
+// PublishMessageByCidAcked is PublishMessageByCid, acked is called once the
+// client acks the QoS 1/2 message, on this node or on the one it was
+// forwarded to. queued is called first if the client is offline and the
+// message waits in the queue of its session. forwarded tells the message
+// went to another node.
+func (b *Broker) PublishMessageByCidAcked(cid string, packet *packets.PublishPacket, acked, queued func()) (forwarded bool, err error) {
+	q, err := b.deliverByCid(cid, packet, nil, acked)
+	if err != ErrClientOffline {
+		if q && queued != nil {
+			queued()
 		}
+		return false, err
+	}
+
+	if route, ok := b.owners.Load(cid); ok {
+		ack := b.awaitAck(acked, queued)
+		err := route.(*client).forwardTo(cid, packet, ack)
 		if err != nil {
-			log.Error("write message error,  ", zap.Error(err))
+			b.takeAck(ack)
 		}
-	} else {
-		log.Warn("client not exist", zap.String("clientId", cid))
+		return true, err
+	}
+
+	log.Warn("client not exist", zap.String("clientId", cid))
+	return false, ErrClientOffline
+}
+
+// deliverByCid sends packet to client cid on this node, the offline client
+// of a persistent session queues it, as queued tells.
+func (b *Broker) deliverByCid(cid string, packet *packets.PublishPacket, props *mqtt5.Properties, acked func()) (queued bool, err error) {
+	c, exist := b.clients.Load(cid)
+	if !exist {
+		c, exist = b.offline.Load(cid)
+	}
+	if !exist {
+		return false, ErrClientOffline
+	}
+	cl, ok := c.(*client)
+	if !ok {
+		return false, ErrClientOffline
+	}
+	queued = !cl.connected()
+	if err := cl.deliverAcked(packet, props, packet.Qos, acked); err != nil {
+		return false, err
 	}
+	return queued, nil
 }
 
 func (b *Broker) BroadcastUnSubscribe(subs map[string]*subscription) {
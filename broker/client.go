@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"rocketmqtt/broker/lib/mqtt5"
 	"rocketmqtt/broker/lib/sessions"
 	"rocketmqtt/broker/lib/topics"
 	"rocketmqtt/plugins/bridge"
@@ -47,15 +48,20 @@ var (
 )
 
 type client struct {
-	typ         int
-	mu          sync.Mutex
-	broker      *Broker
-	conn        net.Conn
-	info        info
-	route       route
-	status      int
-	ctx         context.Context
-	cancelFunc  context.CancelFunc
+	typ    int
+	mu     sync.Mutex
+	broker *Broker
+	conn   net.Conn
+	info   info
+	route  route
+	// statusMu guards status, which other goroutines read while mu is held
+	// for as long as a packet is written
+	statusMu   sync.RWMutex
+	status     int
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	// session is set before the client is stored in the broker and never
+	// changes after
 	session     *sessions.Session
 	subMap      map[string]*subscription
 	topicsMgr   *topics.Manager
@@ -63,6 +69,16 @@ type client struct {
 	qoss        []byte
 	rmsgs       []*packets.PublishPacket
 	routeSubMap map[string]uint64
+	// awaitRel holds the ids of QoS 2 publishes already forwarded and
+	// waiting for the PUBREL of the sender, the one of the session once
+	// there is a session
+	awaitRel *sessions.AwaitRel
+	// version is the protocol level of the connection, see mqtt5.Version5
+	version byte
+	// aliases maps the topic aliases of an MQTT 5 client to topic names
+	aliases map[uint16]string
+	// reason is why the connection is closed, for the disconnect event
+	reason string
 }
 
 type subscription struct {
@@ -78,9 +94,20 @@ type info struct {
 	username  string
 	password  []byte
 	keepalive uint16
-	willMsg   *packets.PublishPacket
-	localIP   string
-	remoteIP  string
+	// cleanSession false keeps the subscriptions and queues messages while offline
+	cleanSession bool
+	// sessionExpiry is how long, in seconds, the session of a MQTT 5 client
+	// is kept once it goes offline
+	sessionExpiry uint32
+	// receiveMaximum is how many QoS 1/2 messages a MQTT 5 client accepts at once
+	receiveMaximum uint16
+	willMsg        *packets.PublishPacket
+	willProps      *mqtt5.Properties
+	localIP        string
+	remoteIP       string
+	// connectedAt is when the client connected, in unix nanoseconds of the
+	// cluster clock
+	connectedAt int64
 }
 
 type route struct {
@@ -94,7 +121,9 @@ var (
 )
 
 func (c *client) init() {
+	c.statusMu.Lock()
 	c.status = Connected
+	c.statusMu.Unlock()
 	c.info.localIP, _, _ = net.SplitHostPort(c.conn.LocalAddr().String())
 	remoteAddr := c.conn.RemoteAddr()
 	remoteNetwork := remoteAddr.Network()
@@ -109,6 +138,8 @@ func (c *client) init() {
 	c.subMap = make(map[string]*subscription)
 	c.topicsMgr = c.broker.topicsMgr
 	c.routeSubMap = make(map[string]uint64)
+	c.awaitRel = sessions.NewAwaitRel()
+	c.aliases = make(map[uint16]string)
 }
 
 func (c *client) readLoop() {
@@ -139,9 +170,12 @@ func (c *client) readLoop() {
 				}
 			}
 
-			packet, err := packets.ReadPacket(nc)
+			packet, ext, err := mqtt5.ReadPacket(nc, c.version)
 			if err != nil {
 				log.Debug("read packet error: ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.sendDisconnect(mqtt5.KeepAliveTimeout)
+				}
 				msg := &Message{
 					client: c,
 					packet: DisconnectedPacket,
@@ -150,6 +184,19 @@ func (c *client) readLoop() {
 				return
 			}
 
+			if p, ok := packet.(*packets.PublishPacket); ok && ext != nil {
+				if code := c.resolveTopicAlias(p, ext.Properties.TopicAlias); code != mqtt5.Success {
+					log.Error("bad topic alias", zap.Uint8("reason", code), zap.String("ClientID", c.info.clientID))
+					c.sendDisconnect(code)
+					msg := &Message{
+						client: c,
+						packet: DisconnectedPacket,
+					}
+					b.SubmitWork(c.info.clientID, msg)
+					return
+				}
+			}
+
 			//msg := &Message{
 			//	client: c,
 			//	packet: packet,
@@ -157,6 +204,7 @@ func (c *client) readLoop() {
 			msg := c.broker.msgsPool.Get().(*Message)
 			msg.client = c
 			msg.packet = packet
+			msg.ext = ext
 
 			b.SubmitWork(c.info.clientID, msg)
 		}
@@ -180,11 +228,15 @@ func ProcessMessage(msg *Message) {
 	case *packets.ConnectPacket:
 	case *packets.PublishPacket:
 		// packet := ca.(*packets.PublishPacket)
-		c.ProcessPublish(ca)
+		c.ProcessPublish(ca, msg.ext.Props())
 	case *packets.PubackPacket:
+		c.ProcessPuback(ca)
 	case *packets.PubrecPacket:
+		c.ProcessPubrec(ca)
 	case *packets.PubrelPacket:
+		c.ProcessPubrel(ca)
 	case *packets.PubcompPacket:
+		c.ProcessPubcomp(ca)
 	case *packets.SubscribePacket:
 		// packet := ca.(*packets.SubscribePacket)
 		c.ProcessSubscribe(ca)
@@ -197,7 +249,11 @@ func ProcessMessage(msg *Message) {
 		c.ProcessPing()
 	case *packets.PingrespPacket:
 	case *packets.DisconnectPacket:
-		c.Close()
+		//DisconnectedPacket stands for a connection lost or closed by the broker
+		if ca != DisconnectedPacket && c.reason == "" {
+			c.reason = bridge.ReasonNormal
+		}
+		c.ProcessDisconnect(msg.ext)
 	default:
 		log.Info("Recv Unknow message.......", zap.String("ClientID", c.info.clientID))
 	}
@@ -205,12 +261,53 @@ func ProcessMessage(msg *Message) {
 	c.broker.msgsPool.Put(msg)
 }
 
-func (c *client) ProcessPublish(packet *packets.PublishPacket) {
+// resolveTopicAlias sets the topic name of a MQTT 5 publish sent with a topic
+// alias, or records the alias when the name is given as well.
+func (c *client) resolveTopicAlias(packet *packets.PublishPacket, alias *uint16) byte {
+	if alias == nil {
+		return mqtt5.Success
+	}
+	if *alias == 0 || *alias > c.broker.topicAliasMaximum() {
+		return mqtt5.TopicAliasInvalid
+	}
+
+	if packet.TopicName != "" {
+		c.aliases[*alias] = packet.TopicName
+		return mqtt5.Success
+	}
+
+	topic, ok := c.aliases[*alias]
+	if !ok {
+		return mqtt5.ProtocolError
+	}
+	packet.TopicName = topic
+	return mqtt5.Success
+}
+
+func (c *client) ProcessDisconnect(ext *mqtt5.Ext) {
+	if ext != nil {
+		// only a MQTT 5 client may ask for its will to be published on a
+		// normal disconnect
+		if ext.ReasonCode != mqtt5.DisconnectWithWill {
+			c.info.willMsg = nil
+		}
+		// the expiry can be changed, but not from 0 which ended the session already
+		if e := ext.Properties.SessionExpiry; e != nil && c.info.sessionExpiry > 0 && c.session != nil {
+			c.info.sessionExpiry = *e
+			c.info.cleanSession = *e == 0
+			c.session.SetExpiry(*e)
+			c.broker.saveSession(c)
+		}
+	}
+	c.Close()
+}
+
+func (c *client) ProcessPublish(packet *packets.PublishPacket, props *mqtt5.Properties) {
 	switch c.typ {
 	case CLIENT:
-		c.processClientPublish(packet)
-	case ROUTER:
-		c.processRouterPublish(packet)
+		c.processClientPublish(packet, clientProps(props))
+	case ROUTER, REMOTE:
+		c.processRouterPublish(packet, props)
 	case CLUSTER:
 		c.processRemotePublish(packet)
 	}
@@ -218,7 +315,7 @@ func (c *client) ProcessPublish(packet *packets.PublishPacket) {
 }
 
 func (c *client) processRemotePublish(packet *packets.PublishPacket) {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 
@@ -230,14 +327,50 @@ func (c *client) processRemotePublish(packet *packets.PublishPacket) {
 
 }
 
-func (c *client) processRouterPublish(packet *packets.PublishPacket) {
-	if c.status == Disconnected {
+// processRouterPublish handles a message forwarded by another node, it's
+// only delivered to the local clients.
+func (c *client) processRouterPublish(packet *packets.PublishPacket, props *mqtt5.Properties) {
+	if !c.connected() {
+		return
+	}
+
+	switch packet.TopicName {
+	case takeoverTopic:
+		c.processTakeover(packet)
+		return
+	case releaseTopic:
+		c.processRelease(packet)
+		return
+	case ackedTopic:
+		c.processAcked(packet)
+		return
+	case queuedTopic:
+		c.processQueued(packet)
 		return
 	}
 
+	props, shared, cid, ack := splitRouteProps(props)
+	process := func() {
+		if cid == "" {
+			c.ProcessPublishMessage(packet, props, shared)
+			return
+		}
+		//a downlink message for a client of this node only
+		var acked func()
+		if ack != "" {
+			acked = func() { c.sendAckNotice(ackedTopic, ack) }
+		}
+		queued, err := c.broker.deliverByCid(cid, packet, props, acked)
+		if err != nil {
+			log.Warn("deliver forwarded message error", zap.Error(err), zap.String("clientId", cid))
+		} else if queued && ack != "" {
+			c.sendAckNotice(queuedTopic, ack)
+		}
+	}
+
 	switch packet.Qos {
 	case QosAtMostOnce:
-		c.ProcessPublishMessage(packet)
+		process()
 	case QosAtLeastOnce:
 		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 		puback.MessageID = packet.MessageID
@@ -245,9 +378,13 @@ func (c *client) processRouterPublish(packet *packets.PublishPacket) {
 			log.Error("send puback error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 			return
 		}
-		c.ProcessPublishMessage(packet)
+		process()
 	case QosExactlyOnce:
-		return
+		if !c.isQos2Duplicate(packet) {
+			process()
+			c.awaitRel.Add(packet.MessageID)
+		}
+		c.sendPubrec(packet.MessageID)
 	default:
 		log.Error("publish with unknown qos", zap.String("ClientID", c.info.clientID))
 		return
@@ -255,7 +392,7 @@ func (c *client) processRouterPublish(packet *packets.PublishPacket) {
 
 }
 
-func (c *client) processClientPublish(packet *packets.PublishPacket) {
+func (c *client) processClientPublish(packet *packets.PublishPacket, props *mqtt5.Properties) {
 
 	// count upstream
 	CountIncrease(&MessageUpCount)
@@ -264,6 +401,14 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 
 	if !c.broker.CheckTopicAuth(PUB, c.info.clientID, c.info.username, c.info.remoteIP, topic) {
 		log.Error("Pub Topics Auth failed, ", zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
+		c.sendPubError(packet, mqtt5.NotAuthorized)
+		return
+	}
+
+	// the notices of the routes only come from a peer
+	if strings.HasPrefix(topic, routeTopicPrefix) {
+		log.Error("publish to a route topic", zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
+		c.sendPubError(packet, mqtt5.TopicNameInvalid)
 		return
 	}
 
@@ -280,20 +425,36 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 		return
 	}
 
+	// a redelivered QoS 2 publish has already been forwarded, only ack it again
+	if c.isQos2Duplicate(packet) {
+		c.sendPubrec(packet.MessageID)
+		return
+	}
+
 	e := c.broker.elementsPool.Get().(*bridge.Elements)
 
 	e.ClientID = c.info.clientID
+	e.Username = c.info.username
 	e.Action = bridge.Publish
 	e.Payload = packet.Payload
+	e.Size = int32(len(packet.Payload))
 	e.Topic = topic
+	e.Qos = packet.Qos
+	e.Timestamp = time.Now().UnixNano()
 
-	c.broker.Publish(e)
+	err := c.broker.Publish(e)
 
 	c.broker.elementsPool.Put(e)
 
+	//without the ack the client sends the message again
+	if err != nil && packet.Qos > QosAtMostOnce {
+		log.Warn("bridge did not confirm the message, hold back the ack", zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
+		return
+	}
+
 	switch packet.Qos {
 	case QosAtMostOnce:
-		c.ProcessPublishMessage(packet)
+		c.ProcessPublishMessage(packet, props, nil)
 	case QosAtLeastOnce:
 		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 		puback.MessageID = packet.MessageID
@@ -301,16 +462,78 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 			log.Error("send puback error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 			return
 		}
-		c.ProcessPublishMessage(packet)
+		c.ProcessPublishMessage(packet, props, nil)
 	case QosExactlyOnce:
-		return
+		c.ProcessPublishMessage(packet, props, nil)
+		c.awaitRel.Add(packet.MessageID)
+		c.sendPubrec(packet.MessageID)
 	default:
 		log.Error("publish with unknown qos", zap.String("ClientID", c.info.clientID))
 		return
 	}
 }
 
-func (c *client) ProcessPublishMessage(packet *packets.PublishPacket) {
+// isQos2Duplicate reports whether packet is a QoS 2 publish whose id is still
+// waiting for PUBREL, which means it was forwarded once already.
+func (c *client) isQos2Duplicate(packet *packets.PublishPacket) bool {
+	if packet.Qos != QosExactlyOnce {
+		return false
+	}
+	return c.awaitRel.Waiting(packet.MessageID)
+}
+
+// sendPubError tells a MQTT 5 client why its QoS 1/2 publish was refused,
+// 3.1.1 has no way to do it.
+func (c *client) sendPubError(packet *packets.PublishPacket, reason byte) {
+	if c.version != mqtt5.Version5 {
+		return
+	}
+
+	var ack packets.ControlPacket
+	switch packet.Qos {
+	case QosAtLeastOnce:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = packet.MessageID
+		ack = puback
+	case QosExactlyOnce:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = packet.MessageID
+		ack = pubrec
+	default:
+		return
+	}
+
+	if err := c.WriterPacketExt(ack, &mqtt5.Ext{ReasonCode: reason}); err != nil {
+		log.Error("send publish ack error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+func (c *client) sendPubrec(messageID uint16) {
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = messageID
+	if err := c.WriterPacket(pubrec); err != nil {
+		log.Error("send pubrec error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+func (c *client) ProcessPubrel(packet *packets.PubrelPacket) {
+	if !c.connected() {
+		return
+	}
+
+	// the id is released even if it is unknown, PUBCOMP must be sent anyway
+	c.awaitRel.Release(packet.MessageID)
+
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = packet.MessageID
+	if err := c.WriterPacket(pubcomp); err != nil {
+		log.Error("send pubcomp error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+// ProcessPublishMessage delivers packet to the subscribers, shared limits the
+// share groups delivered to for a message forwarded by another node.
+func (c *client) ProcessPublishMessage(packet *packets.PublishPacket, props *mqtt5.Properties, shared map[string]bool) {
 
 	b := c.broker
 	if b == nil {
@@ -335,31 +558,22 @@ func (c *client) ProcessPublishMessage(packet *packets.PublishPacket) {
 		return
 	}
 
-	var qsub []int
-	for i, sub := range c.subs {
-		s, ok := sub.(*subscription)
-		if ok {
-			if s.client.typ == ROUTER {
-				if typ != CLIENT {
-					continue
-				}
-			}
-			if s.share {
-				qsub = append(qsub, i)
-			} else {
-				publish(s, packet)
-			}
-
-		}
+	// only messages of local clients go on to the routers
+	b.dispatch(c.subs, packet, props, c.info.clientID, typ == CLIENT, shared)
+}
 
+// splitShareTopic returns the topic filter and group of a $share/group/topic
+// subscription, a plain topic is returned as is.
+func splitShareTopic(t string) (topic string, groupName string, share bool, ok bool) {
+	if !strings.HasPrefix(t, "$share/") {
+		return t, "", false, true
 	}
 
-	if len(qsub) > 0 {
-		idx := r.Intn(len(qsub))
-		sub := c.subs[qsub[idx]].(*subscription)
-		publish(sub, packet)
+	substr := groupCompile.FindStringSubmatch(t)
+	if len(substr) != 3 {
+		return t, "", false, false
 	}
-
+	return substr[2], substr[1], true, true
 }
 
 func (c *client) ProcessSubscribe(packet *packets.SubscribePacket) {
@@ -374,7 +588,7 @@ func (c *client) ProcessSubscribe(packet *packets.SubscribePacket) {
 }
 
 func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 
@@ -388,6 +602,11 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
 	var retcodes []byte
+	// granted qos of the subscription each retained message matched
+	var rqoss []byte
+	c.rmsgs = c.rmsgs[0:0]
+	// new subscriptions, for the other nodes of the cluster
+	added := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
 
 	for i, topic := range topics {
 		t := topic
@@ -398,28 +617,14 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 			continue
 		}
 
-		b.Publish(&bridge.Elements{
-			ClientID:  c.info.clientID,
-			Username:  c.info.username,
-			Action:    bridge.Subscribe,
-			Timestamp: time.Now().UnixNano(),
-			Topic:     topic,
-		})
-
-		groupName := ""
-		share := false
-		if strings.HasPrefix(topic, "$share/") {
-			substr := groupCompile.FindStringSubmatch(topic)
-			if len(substr) != 3 {
-				retcodes = append(retcodes, QosFailure)
-				continue
-			}
-			share = true
-			groupName = substr[1]
-			topic = substr[2]
+		topic, groupName, share, ok := splitShareTopic(t)
+		if !ok {
+			retcodes = append(retcodes, QosFailure)
+			continue
 		}
 
-		if oldSub, exist := c.subMap[t]; exist {
+		oldSub, exist := c.subMap[t]
+		if exist {
 			c.topicsMgr.Unsubscribe([]byte(oldSub.topic), oldSub)
 			delete(c.subMap, t)
 		}
@@ -440,13 +645,25 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 		}
 
 		c.subMap[t] = sub
+		if !exist {
+			added.Topics = append(added.Topics, t)
+			added.Qoss = append(added.Qoss, qoss[i])
+		}
+		// a subscription made again is only an event when its qos changed
+		if !exist || oldSub.qos != qoss[i] {
+			c.publishEvent(bridge.Subscribe, t, qoss[i])
+		}
 
 		c.session.AddTopic(t, qoss[i])
 		retcodes = append(retcodes, rqos)
 		c.topicsMgr.Retained([]byte(topic), &c.rmsgs)
+		for len(rqoss) < len(c.rmsgs) {
+			rqoss = append(rqoss, rqos)
+		}
 	}
 
 	suback.ReturnCodes = retcodes
+	b.saveSession(c)
 
 	err := c.WriterPacket(suback)
 	if err != nil {
@@ -454,20 +671,18 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 		return
 	}
 	//broadcast subscribe message
-	go b.BroadcastSubOrUnsubMessage(packet)
+	if len(added.Topics) > 0 {
+		b.BroadcastSubOrUnsubMessage(added)
+	}
 
 	//process retain message
-	for _, rm := range c.rmsgs {
-		if err := c.WriterPacket(rm); err != nil {
-			log.Error("Error publishing retained message:", zap.Any("err", err), zap.String("ClientID", c.info.clientID))
-		} else {
-			log.Info("process retain  message: ", zap.Any("packet", packet), zap.String("ClientID", c.info.clientID))
-		}
+	for i, rm := range c.rmsgs {
+		c.deliver(rm, nil, rqoss[i])
 	}
 }
 
 func (c *client) processRouterSubscribe(packet *packets.SubscribePacket) {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 
@@ -484,17 +699,17 @@ func (c *client) processRouterSubscribe(packet *packets.SubscribePacket) {
 
 	for i, topic := range topics {
 		t := topic
-		groupName := ""
-		share := false
-		if strings.HasPrefix(topic, "$share/") {
-			substr := groupCompile.FindStringSubmatch(topic)
-			if len(substr) != 3 {
-				retcodes = append(retcodes, QosFailure)
-				continue
-			}
-			share = true
-			groupName = substr[1]
-			topic = substr[2]
+		// a route subscribes a topic once for all the clients of its node
+		if sub, exist := c.subMap[t]; exist {
+			addSubMap(c.routeSubMap, t)
+			retcodes = append(retcodes, sub.qos)
+			continue
+		}
+
+		topic, groupName, share, ok := splitShareTopic(t)
+		if !ok {
+			retcodes = append(retcodes, QosFailure)
+			continue
 		}
 
 		sub := &subscription{
@@ -513,7 +728,7 @@ func (c *client) processRouterSubscribe(packet *packets.SubscribePacket) {
 		}
 
 		c.subMap[t] = sub
-		addSubMap(c.routeSubMap, topic)
+		addSubMap(c.routeSubMap, t)
 		retcodes = append(retcodes, rqos)
 	}
 
@@ -536,7 +751,7 @@ func (c *client) ProcessUnSubscribe(packet *packets.UnsubscribePacket) {
 }
 
 func (c *client) processRouterUnSubscribe(packet *packets.UnsubscribePacket) {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 	b := c.broker
@@ -544,25 +759,29 @@ func (c *client) processRouterUnSubscribe(packet *packets.UnsubscribePacket) {
 		return
 	}
 	topics := packet.Topics
+	ext := &mqtt5.Ext{}
 
 	for _, topic := range topics {
 		sub, exist := c.subMap[topic]
-		if exist {
-			retainNum := delSubMap(c.routeSubMap, topic)
-			if retainNum > 0 {
-				continue
-			}
+		if !exist {
+			ext.ReasonCodes = append(ext.ReasonCodes, mqtt5.NoSubscriptionExisted)
+			continue
+		}
+		ext.ReasonCodes = append(ext.ReasonCodes, mqtt5.Success)
 
-			c.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
-			delete(c.subMap, topic)
+		retainNum := delSubMap(c.routeSubMap, topic)
+		if retainNum > 0 {
+			continue
 		}
 
+		c.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
+		delete(c.subMap, topic)
 	}
 
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
 
-	err := c.WriterPacket(unsuback)
+	err := c.WriterPacketExt(unsuback, ext)
 	if err != nil {
 		log.Error("send unsuback error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 		return
@@ -570,7 +789,7 @@ func (c *client) processRouterUnSubscribe(packet *packets.UnsubscribePacket) {
 }
 
 func (c *client) processClientUnSubscribe(packet *packets.UnsubscribePacket) {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 	b := c.broker
@@ -578,43 +797,43 @@ func (c *client) processClientUnSubscribe(packet *packets.UnsubscribePacket) {
 		return
 	}
 	topics := packet.Topics
+	// reason codes for a MQTT 5 client
+	ext := &mqtt5.Ext{}
+	// removed subscriptions, for the other nodes of the cluster
+	removed := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
 
 	for _, topic := range topics {
-		{
-			//publish kafka
-
-			b.Publish(&bridge.Elements{
-				ClientID:  c.info.clientID,
-				Username:  c.info.username,
-				Action:    bridge.Unsubscribe,
-				Timestamp: time.Now().UnixNano(),
-				Topic:     topic,
-			})
-		}
-
 		sub, exist := c.subMap[topic]
 		if exist {
 			c.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
 			c.session.RemoveTopic(topic)
 			delete(c.subMap, topic)
+			removed.Topics = append(removed.Topics, topic)
+			ext.ReasonCodes = append(ext.ReasonCodes, mqtt5.Success)
+			c.publishEvent(bridge.Unsubscribe, topic, 0)
+		} else {
+			ext.ReasonCodes = append(ext.ReasonCodes, mqtt5.NoSubscriptionExisted)
 		}
 
 	}
+	b.saveSession(c)
 
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
 
-	err := c.WriterPacket(unsuback)
+	err := c.WriterPacketExt(unsuback, ext)
 	if err != nil {
 		log.Error("send unsuback error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 		return
 	}
 	// //process ubsubscribe message
-	b.BroadcastSubOrUnsubMessage(packet)
+	if len(removed.Topics) > 0 {
+		b.BroadcastSubOrUnsubMessage(removed)
+	}
 }
 
 func (c *client) ProcessPing() {
-	if c.status == Disconnected {
+	if !c.connected() {
 		return
 	}
 	resp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
@@ -625,49 +844,58 @@ func (c *client) ProcessPing() {
 	}
 }
 
+// connected tells whether the client is connected, from any goroutine
+func (c *client) connected() bool {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+	return c.status == Connected
+}
+
 func (c *client) Close() {
+	c.statusMu.Lock()
 	if c.status == Disconnected {
+		c.statusMu.Unlock()
 		return
 	}
+	c.status = Disconnected
+	c.statusMu.Unlock()
 
 	c.cancelFunc()
 
-	c.status = Disconnected
 	//wait for message complete
 	// time.Sleep(1 * time.Second)
 	// c.status = Disconnected
 
 	b := c.broker
-	b.Publish(&bridge.Elements{
-		ClientID:  c.info.clientID,
-		Username:  c.info.username,
-		Action:    bridge.Disconnect,
-		Timestamp: time.Now().UnixNano(),
-	})
+	if c.typ == CLIENT {
+		c.publishEvent(bridge.Disconnect, "", 0)
+	}
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
 	}
 
-	subs := c.subMap
-
 	if b != nil {
 		b.removeClient(c)
-		for _, sub := range subs {
-			err := b.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
-			if err != nil {
-				log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		if c.typ == CLIENT && !c.info.cleanSession {
+			//keep the subscriptions of a persistent session, messages are
+			//queued in the session until the client comes back
+			b.offline.Store(c.info.clientID, c)
+			b.expireSession(c)
+		} else {
+			c.unsubscribeLocal()
+			if c.typ == CLIENT {
+				b.BroadcastUnSubscribe(c.subMap)
+				b.BroadcastRelease(c)
 			}
+			b.removeSession(c)
 		}
 
-		if c.typ == CLIENT {
-			b.BroadcastUnSubscribe(subs)
-			//offline notification
-			//b.OnlineOfflineNotification(c.info.clientID, false)
-		}
+		//offline notification
+		//b.OnlineOfflineNotification(c.info.clientID, false)
 
 		if c.info.willMsg != nil {
-			b.PublishMessage(c.info.willMsg)
+			b.publishMessage(c.info.willMsg, c.info.willProps)
 		}
 
 		//if c.typ == CLUSTER {
@@ -681,13 +909,115 @@ func (c *client) Close() {
 	}
 }
 
+// unsubscribeLocal removes the subscriptions of c from the topic tree.
+func (c *client) unsubscribeLocal() {
+	b := c.broker
+	for _, sub := range c.subMap {
+		err := b.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
+		if err != nil {
+			log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		}
+	}
+}
+
+// restoreSubscriptions subscribes again the topics recorded in a resumed
+// session, so that SessionPresent also means the subscriptions are in place.
+func (c *client) restoreSubscriptions() {
+	topics, qoss, err := c.session.Topics()
+	if err != nil {
+		log.Error("get session topics error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		return
+	}
+
+	for i, t := range topics {
+		topic, groupName, share, ok := splitShareTopic(t)
+		if !ok {
+			continue
+		}
+
+		sub := &subscription{
+			topic:     topic,
+			qos:       qoss[i],
+			client:    c,
+			share:     share,
+			groupName: groupName,
+		}
+		if _, err := c.topicsMgr.Subscribe([]byte(topic), qoss[i], sub); err != nil {
+			log.Error("subscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			continue
+		}
+		c.subMap[t] = sub
+	}
+}
+
+// Disconnect closes the connection of c, a MQTT 5 client is told why with a
+// DISCONNECT packet first.
+func (c *client) Disconnect(reason byte) {
+	c.sendDisconnect(reason)
+	c.Close()
+}
+
+func (c *client) sendDisconnect(reason byte) {
+	c.reason = disconnectReason(reason)
+	if c.version != mqtt5.Version5 {
+		return
+	}
+	disconnect := packets.NewControlPacket(packets.Disconnect)
+	if err := c.WriterPacketExt(disconnect, &mqtt5.Ext{ReasonCode: reason}); err != nil {
+		log.Debug("send disconnect error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+// disconnectReason is the reason of the disconnect event for a DISCONNECT
+// reason code sent by the broker
+func disconnectReason(code byte) string {
+	switch code {
+	case mqtt5.KeepAliveTimeout:
+		return bridge.ReasonKeepaliveTimeout
+	case mqtt5.SessionTakenOver:
+		return bridge.ReasonTakenOver
+	case mqtt5.AdministrativeAction:
+		return bridge.ReasonKicked
+	}
+	return bridge.ReasonProtocolError
+}
+
+// publishEvent sends a lifecycle event of the client to the bridge, qos is
+// the one asked for by a subscribe
+func (c *client) publishEvent(action, topic string, qos byte) {
+	reason := ""
+	if action == bridge.Disconnect {
+		reason = c.reason
+		if reason == "" {
+			reason = bridge.ReasonConnectionLost
+		}
+	}
+	c.broker.Publish(&bridge.Elements{
+		ClientID:  c.info.clientID,
+		Username:  c.info.username,
+		IP:        c.info.remoteIP,
+		Keepalive: c.info.keepalive,
+		Action:    action,
+		Timestamp: time.Now().UnixNano(),
+		Topic:     topic,
+		Qos:       qos,
+		Reason:    reason,
+	})
+}
+
 func (c *client) WriterPacket(packet packets.ControlPacket) error {
+	return c.WriterPacketExt(packet, nil)
+}
+
+// WriterPacketExt writes packet with the reason codes and properties of ext,
+// ext is left out for a 3.1.1 client.
+func (c *client) WriterPacketExt(packet packets.ControlPacket, ext *mqtt5.Ext) error {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error("recover error, ", zap.Any("recover", r))
 		}
 	}()
-	if c.status == Disconnected {
+	if !c.connected() {
 		return nil
 	}
 
@@ -699,8 +1029,13 @@ func (c *client) WriterPacket(packet packets.ControlPacket) error {
 		return errors.New("connect lost")
 	}
 
+	var err error
 	c.mu.Lock()
-	err := packet.Write(c.conn)
+	if c.version == mqtt5.Version5 {
+		err = mqtt5.WritePacket(c.conn, packet, ext)
+	} else {
+		err = packet.Write(c.conn)
+	}
 	c.mu.Unlock()
 	return err
 }
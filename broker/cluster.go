@@ -0,0 +1,508 @@
+package broker
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"rocketmqtt/broker/lib/mqtt5"
+	"rocketmqtt/broker/lib/sessions"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.uber.org/zap"
+)
+
+// A node dials every peer of the cluster, the outgoing connection (REMOTE)
+// carries the subscriptions of the local clients to the peer, and the peer
+// answers on the same connection (ROUTER on its side) with the messages that
+// match them. Routes use MQTT 5 so a forwarded message can carry the share
+// groups the receiving node has to deliver it to. Forwarded messages are only
+// delivered locally, never forwarded again.
+
+// the user properties and topics of the routes start with these, a client
+// can't use them
+const (
+	routePropPrefix  = "$rocketmqtt-"
+	routeTopicPrefix = "$rocketmqtt/"
+)
+
+// routeShareProp is the user property naming a share group the node a
+// message is forwarded to has to deliver it to
+const routeShareProp = "$rocketmqtt-share"
+
+// takeoverTopic is the topic of the notice a node sends its peers when a
+// client connects, so that they drop the connection and session they hold
+// for the same client id
+const takeoverTopic = "$rocketmqtt/takeover"
+
+// releaseTopic is the topic of the notice a node sends its peers when a
+// client it owned is gone, with its session
+const releaseTopic = "$rocketmqtt/release"
+
+// routeClientProp is the user property naming the only client a forwarded
+// message goes to, as for a downlink message
+const routeClientProp = "$rocketmqtt-client"
+
+// routeAckProp is the user property of a forwarded downlink whose origin
+// waits for the client ack, the node of the client answers with an ackedTopic
+// notice carrying its value
+const routeAckProp = "$rocketmqtt-ack"
+
+// ackedTopic is the topic of the notice a node sends back on the route a
+// downlink came from once its client acked it, queuedTopic the one of a
+// downlink its offline client queued
+const (
+	ackedTopic  = "$rocketmqtt/acked"
+	queuedTopic = "$rocketmqtt/queued"
+)
+
+// how long the origin of a forwarded downlink waits for its ack, longer once
+// the offline client queued it
+const (
+	forwardAckTTL = 10 * time.Minute
+	queuedAckTTL  = 24 * time.Hour
+)
+
+// window and queue of a route when the config leaves them 0
+const (
+	defaultRouteInflight = 1024
+	defaultRouteQueued   = 100000
+)
+
+type takeover struct {
+	ClientID string `json:"clientID"`
+	// ConnectedAt is when the client connected, in unix nanoseconds of the
+	// cluster clock of Node
+	ConnectedAt int64  `json:"connectedAt"`
+	Node        string `json:"node"`
+}
+
+// clusterClock stamps the connections of the clients. It's the wall clock,
+// but never behind a stamp seen from a peer: a client connecting after the
+// takeover notice of another node came in is newer than the one it takes
+// over, however far apart the clocks of the nodes are.
+type clusterClock struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func (cc *clusterClock) now() int64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	t := time.Now().UnixNano()
+	if t <= cc.last {
+		t = cc.last + 1
+	}
+	cc.last = t
+	return t
+}
+
+// observe moves the clock past the stamp of a peer
+func (cc *clusterClock) observe(t int64) {
+	cc.mu.Lock()
+	if t > cc.last {
+		cc.last = t
+	}
+	cc.mu.Unlock()
+}
+
+// nodeName tells the nodes apart when two connections have the same stamp,
+// the broker id or, without one, the cluster address.
+func (b *Broker) nodeName() string {
+	if b.id != "" {
+		return b.id
+	}
+	return b.config.Cluster.Host + ":" + b.config.Cluster.Port
+}
+
+// newer tells whether the connection stamped at on node is newer than the
+// one stamped other on otherNode. Every node orders a pair the same way, so
+// only one of two concurrent connections is kept.
+func newer(at int64, node string, other int64, otherNode string) bool {
+	if at != other {
+		return at > other
+	}
+	return node > otherNode
+}
+
+func (b *Broker) StartClusterListening() {
+	var hp string = b.config.Cluster.Host + ":" + b.config.Cluster.Port
+	log.Info("Start Listening cluster on ", zap.String("hp", hp))
+
+	l, e := net.Listen("tcp", hp)
+	if e != nil {
+		log.Error("Error listening on ", zap.Error(e))
+		return
+	}
+
+	tmpDelay := 10 * ACCEPT_MIN_SLEEP
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Error("Temporary Client Accept Error(%v), sleeping %dms",
+					zap.Error(ne), zap.Duration("sleeping", tmpDelay/time.Millisecond))
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else {
+				log.Error("Accept error: %v", zap.Error(err))
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+
+		go b.handleConnection(ROUTER, conn)
+	}
+}
+
+// ConnectToPeers dials the static peers of the cluster config, a peer is
+// known by its address.
+func (b *Broker) ConnectToPeers() {
+	self := b.config.Cluster.Host + ":" + b.config.Cluster.Port
+	for _, peer := range b.config.Cluster.Peers {
+		if peer == self {
+			continue
+		}
+		b.nodes[peer] = peer
+	}
+
+	for id, peer := range b.nodes {
+		go b.connectRouter(id, peer.(string))
+	}
+}
+
+// routeLimits is the outbound window, queue size and drop policy of the
+// session of a route.
+func (b *Broker) routeLimits() (int, int, string) {
+	maxInflight, maxQueued := defaultRouteInflight, defaultRouteQueued
+	if n := b.config.Cluster.MaxInflight; n > 0 {
+		maxInflight = n
+	}
+	if n := b.config.Cluster.MaxQueued; n > 0 {
+		maxQueued = n
+	}
+	return maxInflight, maxQueued, sessions.DropNewest
+}
+
+// forward sends a message of this node to the peer of route c, naming the
+// share groups it is left to deliver to.
+func (c *client) forward(packet *packets.PublishPacket, props *mqtt5.Properties, groups []string) {
+	if len(groups) > 0 {
+		p := &mqtt5.Properties{}
+		if props != nil {
+			p = props.Copy()
+		}
+		user := make([]mqtt5.UserProperty, len(p.User), len(p.User)+len(groups))
+		copy(user, p.User)
+		for _, g := range groups {
+			user = append(user, mqtt5.UserProperty{Key: routeShareProp, Value: g})
+		}
+		p.User = user
+		props = p
+	}
+
+	if err := c.deliver(packet, props, packet.Qos); err != nil {
+		log.Warn("forward message to route error", zap.Error(err), zap.String("topic", packet.TopicName), zap.String("route", c.info.clientID))
+	}
+}
+
+// clientProps are the properties of a client publish that are passed on,
+// without the route ones: a peer would deliver the message to the client
+// or share group they name, around the subscriptions and the ACL.
+func clientProps(props *mqtt5.Properties) *mqtt5.Properties {
+	props = props.Forward()
+	if props == nil {
+		return nil
+	}
+	var user []mqtt5.UserProperty
+	for _, u := range props.User {
+		if !strings.HasPrefix(u.Key, routePropPrefix) {
+			user = append(user, u)
+		}
+	}
+	if len(user) == len(props.User) {
+		return props
+	}
+	props.User = user
+	return props.Forward()
+}
+
+// splitRouteProps takes the share groups, the target client and the ack id
+// out of the properties of a forwarded message.
+func splitRouteProps(props *mqtt5.Properties) (*mqtt5.Properties, map[string]bool, string, string) {
+	shared := make(map[string]bool)
+	props = props.Forward()
+	if props == nil || len(props.User) == 0 {
+		return props, shared, "", ""
+	}
+
+	var cid, ack string
+	var user []mqtt5.UserProperty
+	for _, u := range props.User {
+		switch u.Key {
+		case routeShareProp:
+			shared[u.Value] = true
+		case routeClientProp:
+			cid = u.Value
+		case routeAckProp:
+			ack = u.Value
+		default:
+			user = append(user, u)
+		}
+	}
+
+	p := props.Copy()
+	p.User = user
+	return p.Forward(), shared, cid, ack
+}
+
+// SendLocalSubsToRouter tells the peer of a new route about the subscriptions
+// of the local clients, online or offline, one entry per subscription as
+// when they were made.
+func (b *Broker) SendLocalSubsToRouter(c *client) {
+	subInfo := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subInfo.MessageID = 1
+	collect := func(key, value interface{}) bool {
+		client, ok := value.(*client)
+		if ok {
+			for topic, sub := range client.subMap {
+				subInfo.Topics = append(subInfo.Topics, topic)
+				subInfo.Qoss = append(subInfo.Qoss, sub.qos)
+			}
+		}
+		return true
+	}
+	b.clients.Range(collect)
+	b.offline.Range(collect)
+
+	if len(subInfo.Topics) > 0 {
+		err := c.WriterPacket(subInfo)
+		if err != nil {
+			log.Error("Send localsubs To Router error :", zap.Error(err))
+		}
+	}
+}
+
+// BroadcastTakeover tells the peers client c connected to this node.
+func (b *Broker) BroadcastTakeover(c *client) {
+	b.broadcastPresence(takeoverTopic, c)
+}
+
+// BroadcastRelease tells the peers client c is not on this node any more.
+func (b *Broker) BroadcastRelease(c *client) {
+	b.broadcastPresence(releaseTopic, c)
+}
+
+func (b *Broker) broadcastPresence(topic string, c *client) {
+	pub, err := newPresence(topic, c)
+	if err != nil {
+		log.Error("marshal presence error", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		return
+	}
+
+	b.remotes.Range(func(key, value interface{}) bool {
+		r, ok := value.(*client)
+		if ok {
+			if err := r.WriterPacket(pub); err != nil {
+				log.Error("send presence to route error", zap.Error(err), zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
+			}
+		}
+		return true
+	})
+}
+
+func newPresence(topic string, c *client) (*packets.PublishPacket, error) {
+	payload, err := json.Marshal(takeover{
+		ClientID:    c.info.clientID,
+		ConnectedAt: c.info.connectedAt,
+		Node:        c.broker.nodeName(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Payload = payload
+	return pub, nil
+}
+
+// SendLocalClientsToRouter tells the peer of a new route about the clients
+// of this node, online or offline, as if they had just connected.
+func (b *Broker) SendLocalClientsToRouter(r *client) {
+	send := func(key, value interface{}) bool {
+		c, ok := value.(*client)
+		if !ok {
+			return true
+		}
+		pub, err := newPresence(takeoverTopic, c)
+		if err != nil {
+			log.Error("marshal presence error", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			return true
+		}
+		if err := r.WriterPacket(pub); err != nil {
+			log.Error("Send local clients To Router error :", zap.Error(err))
+			return false
+		}
+		return true
+	}
+	b.clients.Range(send)
+	b.offline.Range(send)
+}
+
+// processTakeover closes the local connection of a client that connected to
+// another node and discards its session, the node of route c then owns the
+// client id. A local client newer than the one on the other node is kept.
+func (c *client) processTakeover(packet *packets.PublishPacket) {
+	var t takeover
+	if err := json.Unmarshal(packet.Payload, &t); err != nil || t.ClientID == "" {
+		log.Warn("parse takeover message err", zap.Error(err))
+		return
+	}
+
+	b := c.broker
+	b.clock.observe(t.ConnectedAt)
+	if old, ok := b.clients.Load(t.ClientID); ok {
+		ol, ok := old.(*client)
+		if ok {
+			if newer(ol.info.connectedAt, b.nodeName(), t.ConnectedAt, t.Node) {
+				return
+			}
+			log.Warn("client connected to another node, close old...", zap.String("clientID", t.ClientID))
+			ol.Disconnect(mqtt5.SessionTakenOver)
+		}
+	}
+
+	if off, ok := b.offline.Load(t.ClientID); ok && newer(off.(*client).info.connectedAt, b.nodeName(), t.ConnectedAt, t.Node) {
+		return
+	}
+	//the session now lives on the other node
+	if off, ok := b.takeOffline(t.ClientID); ok {
+		off.unsubscribeLocal()
+		b.BroadcastUnSubscribe(off.subMap)
+		b.removeSession(off)
+	}
+
+	b.mu.Lock()
+	b.owners.Store(t.ClientID, c)
+	b.mu.Unlock()
+}
+
+// processRelease forgets the owner of a client id, unless another node took
+// the client over since.
+func (c *client) processRelease(packet *packets.PublishPacket) {
+	var t takeover
+	if err := json.Unmarshal(packet.Payload, &t); err != nil || t.ClientID == "" {
+		log.Warn("parse release message err", zap.Error(err))
+		return
+	}
+
+	b := c.broker
+	b.mu.Lock()
+	if route, ok := b.owners.Load(t.ClientID); ok && route == c {
+		b.owners.Delete(t.ClientID)
+	}
+	b.mu.Unlock()
+}
+
+// dropOwners forgets the client ids owned by the node of route c once the
+// route is gone, they come back with the next connection of the node.
+func (b *Broker) dropOwners(c *client) {
+	b.owners.Range(func(key, value interface{}) bool {
+		if value == c {
+			b.owners.Delete(key)
+		}
+		return true
+	})
+}
+
+// forwardTo sends a downlink message for client cid to the node of route c,
+// a non empty ack asks that node for an ackedTopic notice once cid acks it.
+func (c *client) forwardTo(cid string, packet *packets.PublishPacket, ack string) error {
+	props := &mqtt5.Properties{
+		User: []mqtt5.UserProperty{{Key: routeClientProp, Value: cid}},
+	}
+	if ack != "" {
+		props.User = append(props.User, mqtt5.UserProperty{Key: routeAckProp, Value: ack})
+	}
+	return c.deliver(packet, props, packet.Qos)
+}
+
+// forwardAck is the acked and queued funcs of a forwarded downlink, dropped
+// once forwardAckTTL passed without an ack
+type forwardAck struct {
+	acked  func()
+	queued func()
+	timer  *time.Timer
+}
+
+// awaitAck keeps acked and queued until the node a downlink is forwarded to
+// tells what its client did with it, the id returned goes with the message.
+func (b *Broker) awaitAck(acked, queued func()) string {
+	if acked == nil && queued == nil {
+		return ""
+	}
+	id := GenUniqueId()
+	fa := &forwardAck{
+		acked:  acked,
+		queued: queued,
+		timer: time.AfterFunc(forwardAckTTL, func() {
+			b.forwardAcks.Delete(id)
+		}),
+	}
+	b.forwardAcks.Store(id, fa)
+	return id
+}
+
+// takeAck forgets the downlink id, it's returned if still waiting.
+func (b *Broker) takeAck(id string) *forwardAck {
+	if id == "" {
+		return nil
+	}
+	v, ok := b.forwardAcks.LoadAndDelete(id)
+	if !ok {
+		return nil
+	}
+	fa := v.(*forwardAck)
+	fa.timer.Stop()
+	return fa
+}
+
+// sendAckNotice tells the node a downlink came from on route c what its
+// client did with it, topic is ackedTopic or queuedTopic.
+func (c *client) sendAckNotice(topic, ack string) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Payload = []byte(ack)
+	if err := c.WriterPacket(pub); err != nil {
+		log.Warn("send ack notice to route error", zap.Error(err), zap.String("topic", topic), zap.String("route", c.info.clientID))
+	}
+}
+
+// processAcked calls the acked func of a downlink this node forwarded, its
+// client acked it on the node of the notice.
+func (c *client) processAcked(packet *packets.PublishPacket) {
+	if fa := c.broker.takeAck(string(packet.Payload)); fa != nil && fa.acked != nil {
+		fa.acked()
+	}
+}
+
+// processQueued calls the queued func of a downlink this node forwarded,
+// the offline client queued it on the node of the notice. Its ack is waited
+// for longer.
+func (c *client) processQueued(packet *packets.PublishPacket) {
+	v, ok := c.broker.forwardAcks.Load(string(packet.Payload))
+	if !ok {
+		return
+	}
+	fa := v.(*forwardAck)
+	fa.timer.Reset(queuedAckTTL)
+	if fa.queued != nil {
+		fa.queued()
+	}
+}
@@ -0,0 +1,474 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"rocketmqtt/broker/lib/mqtt5"
+	"rocketmqtt/broker/lib/sessions"
+	"rocketmqtt/broker/lib/topics"
+	"rocketmqtt/conf"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// node is a broker of the test cluster and the address its clients dial
+type node struct {
+	b    *Broker
+	addr string
+}
+
+var clusterSeq int
+
+// startCluster starts n brokers on localhost ports, each one a peer of the
+// others, and waits until all the routes are up.
+func startCluster(t *testing.T, n int, limits func(*conf.Config)) []*node {
+	t.Helper()
+
+	// no bridge targets, rules or events
+	conf.RunConfig = &conf.Config{}
+
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = "127.0.0.1:" + freePort(t)
+	}
+
+	nodes := make([]*node, n)
+	for i := range nodes {
+		clusterSeq++
+		// the mem providers are shared by name, every node gets its own
+		store := "node" + strconv.Itoa(clusterSeq)
+		topics.Register(store, topics.NewMemProvider())
+		sessions.Register(store, sessions.NewMemProvider())
+
+		cfg := &conf.Config{}
+		cfg.Broker.ID = store
+		cfg.Broker.WorkerNum = 4
+		cfg.Listen.Host = "127.0.0.1"
+		cfg.Listen.Port = freePort(t)
+		cfg.Store.Topics = store
+		cfg.Store.Sessions = store
+		cfg.Cluster.Host = "127.0.0.1"
+		cfg.Cluster.Port = peers[i][len("127.0.0.1:"):]
+		cfg.Cluster.Peers = peers
+		if limits != nil {
+			limits(cfg)
+		}
+
+		b, err := NewBroker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.auth = nil
+		b.Start()
+		nodes[i] = &node{b: b, addr: "tcp://127.0.0.1:" + cfg.Listen.Port}
+	}
+
+	waitFor(t, "routes", func() bool {
+		for _, nd := range nodes {
+			if count(&nd.b.remotes) != n-1 || count(&nd.b.routes) != n-1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	closeAtEnd(t, nodes...)
+	return nodes
+}
+
+// closeAtEnd waits, once the test is over, for the clients of nodes to be
+// gone: the bridge is one per process, the next test opens it again.
+func closeAtEnd(t *testing.T, nodes ...*node) {
+	t.Cleanup(func() {
+		waitFor(t, "clients to close", func() bool {
+			for _, nd := range nodes {
+				if count(&nd.b.clients) != 0 {
+					return false
+				}
+			}
+			return true
+		})
+	})
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func count(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// subscribed waits until topic has n subscribers on b, local clients and
+// routes alike.
+func subscribed(t *testing.T, b *Broker, topic string, n int) {
+	t.Helper()
+	waitFor(t, "subscribers of "+topic, func() bool {
+		var subs []interface{}
+		var qoss []byte
+		b.mu.Lock()
+		err := b.topicsMgr.Subscribers([]byte(topic), 1, &subs, &qoss)
+		b.mu.Unlock()
+		return err == nil && len(subs) == n
+	})
+}
+
+func connect(t *testing.T, nd *node, cid string, clean bool, lost func()) mqtt.Client {
+	t.Helper()
+	opts := mqtt.NewClientOptions().
+		AddBroker(nd.addr).
+		SetClientID(cid).
+		SetCleanSession(clean).
+		SetAutoReconnect(false).
+		SetConnectionLostHandler(func(mqtt.Client, error) {
+			if lost != nil {
+				lost()
+			}
+		})
+	c := mqtt.NewClient(opts)
+	if tk := c.Connect(); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("connect %s: %v", cid, tk.Error())
+	}
+	return c
+}
+
+// receiver collects the payloads of the messages a client gets
+type receiver struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *receiver) handle(_ mqtt.Client, m mqtt.Message) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, string(m.Payload()))
+	r.mu.Unlock()
+}
+
+func (r *receiver) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.msgs)
+}
+
+func (r *receiver) payloads() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.msgs...)
+}
+
+func subscribe(t *testing.T, c mqtt.Client, topic string, r *receiver) {
+	t.Helper()
+	if tk := c.Subscribe(topic, 1, r.handle); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("subscribe %s: %v", topic, tk.Error())
+	}
+}
+
+func publishQos1(t *testing.T, c mqtt.Client, topic string, payload string) {
+	t.Helper()
+	if tk := c.Publish(topic, 1, false, payload); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("publish %s: %v", topic, tk.Error())
+	}
+}
+
+func TestClusterPublish(t *testing.T) {
+	nodes := startCluster(t, 3, nil)
+
+	var r2, r3 receiver
+	sub2 := connect(t, nodes[1], "sub2", true, nil)
+	defer sub2.Disconnect(0)
+	subscribe(t, sub2, "cluster/+/up", &r2)
+	sub3 := connect(t, nodes[2], "sub3", true, nil)
+	defer sub3.Disconnect(0)
+	subscribe(t, sub3, "cluster/#", &r3)
+	subscribed(t, nodes[0].b, "cluster/a/up", 2)
+
+	pub := connect(t, nodes[0], "pub1", true, nil)
+	defer pub.Disconnect(0)
+	publishQos1(t, pub, "cluster/a/up", "hello")
+
+	waitFor(t, "messages", func() bool { return r2.len() == 1 && r3.len() == 1 })
+	// a forwarded message is never forwarded again
+	time.Sleep(200 * time.Millisecond)
+	if r2.len() != 1 || r3.len() != 1 {
+		t.Fatalf("got %v and %v, want one message each", r2.payloads(), r3.payloads())
+	}
+
+	// gone with the unsubscribe on every node
+	if tk := sub3.Unsubscribe("cluster/#"); !tk.WaitTimeout(5 * time.Second) {
+		t.Fatal("unsubscribe timeout")
+	}
+	subscribed(t, nodes[0].b, "cluster/a/up", 1)
+}
+
+func TestClusterSharedSubscription(t *testing.T) {
+	nodes := startCluster(t, 3, nil)
+
+	var r2, r3 receiver
+	sub2 := connect(t, nodes[1], "share2", true, nil)
+	defer sub2.Disconnect(0)
+	subscribe(t, sub2, "$share/g/shared/t", &r2)
+	sub3 := connect(t, nodes[2], "share3", true, nil)
+	defer sub3.Disconnect(0)
+	subscribe(t, sub3, "$share/g/shared/t", &r3)
+	subscribed(t, nodes[0].b, "shared/t", 2)
+
+	pub := connect(t, nodes[0], "sharepub", true, nil)
+	defer pub.Disconnect(0)
+	const total = 50
+	for i := 0; i < total; i++ {
+		publishQos1(t, pub, "shared/t", strconv.Itoa(i))
+	}
+
+	waitFor(t, "shared messages", func() bool { return r2.len()+r3.len() >= total })
+	time.Sleep(200 * time.Millisecond)
+
+	// each message goes to one member of the group only
+	seen := make(map[string]bool)
+	for _, p := range append(r2.payloads(), r3.payloads()...) {
+		if seen[p] {
+			t.Fatalf("message %s delivered twice", p)
+		}
+		seen[p] = true
+	}
+	if len(seen) != total {
+		t.Fatalf("got %d messages, want %d", len(seen), total)
+	}
+}
+
+func TestClusterTakeover(t *testing.T) {
+	nodes := startCluster(t, 3, nil)
+
+	lost := make(chan struct{}, 1)
+	first := connect(t, nodes[0], "roaming", false, func() { lost <- struct{}{} })
+	defer first.Disconnect(0)
+
+	// the same client id on another node takes the connection over
+	var r receiver
+	second := connect(t, nodes[1], "roaming", false, nil)
+	defer second.Disconnect(0)
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first connection not taken over")
+	}
+	waitFor(t, "takeover", func() bool {
+		_, online := nodes[0].b.clients.Load("roaming")
+		_, offline := nodes[0].b.offline.Load("roaming")
+		return !online && !offline
+	})
+	subscribe(t, second, "roaming/down", &r)
+
+	// a downlink sent on any node reaches the client where it is now
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "roaming/down"
+	packet.Qos = 1
+	packet.Payload = []byte("down")
+	waitFor(t, "owner", func() bool {
+		_, ok := nodes[2].b.owners.Load("roaming")
+		return ok
+	})
+	acked := make(chan struct{}, 1)
+	forwarded, err := nodes[2].b.PublishMessageByCidAcked("roaming", packet, func() { acked <- struct{}{} }, nil)
+	if err != nil || !forwarded {
+		t.Fatalf("downlink: forwarded %v, %v", forwarded, err)
+	}
+	waitFor(t, "downlink", func() bool { return r.len() == 1 })
+
+	// the ack of the client comes back from the node it is on
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarded downlink not acked")
+	}
+	if n := count(&nodes[2].b.forwardAcks); n != 0 {
+		t.Fatalf("%d acks still waiting", n)
+	}
+}
+
+func TestClusterForwardQueued(t *testing.T) {
+	nodes := startCluster(t, 2, nil)
+
+	var r receiver
+	c := connect(t, nodes[1], "away", false, nil)
+	subscribe(t, c, "away/down", &r)
+	c.Disconnect(100)
+	waitFor(t, "offline session", func() bool {
+		_, ok := nodes[1].b.offline.Load("away")
+		return ok
+	})
+	waitFor(t, "owner", func() bool {
+		_, ok := nodes[0].b.owners.Load("away")
+		return ok
+	})
+
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "away/down"
+	packet.Qos = 1
+	packet.Payload = []byte("later")
+	acked := make(chan struct{}, 1)
+	queued := make(chan struct{}, 1)
+	forwarded, err := nodes[0].b.PublishMessageByCidAcked("away", packet,
+		func() { acked <- struct{}{} }, func() { queued <- struct{}{} })
+	if err != nil || !forwarded {
+		t.Fatalf("downlink: forwarded %v, %v", forwarded, err)
+	}
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued downlink not reported")
+	}
+
+	// the ack still comes once the client is back
+	opts := mqtt.NewClientOptions().
+		AddBroker(nodes[1].addr).
+		SetClientID("away").
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetDefaultPublishHandler(r.handle)
+	back := mqtt.NewClient(opts)
+	if tk := back.Connect(); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("connect: %v", tk.Error())
+	}
+	defer back.Disconnect(0)
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued downlink not acked")
+	}
+	if r.len() != 1 {
+		t.Fatalf("got %v", r.payloads())
+	}
+}
+
+func TestClusterRouteTopicFromClient(t *testing.T) {
+	nodes := startCluster(t, 2, nil)
+
+	lost := make(chan struct{}, 1)
+	victim := connect(t, nodes[1], "victim", true, func() { lost <- struct{}{} })
+	defer victim.Disconnect(0)
+	var r receiver
+	watcher := connect(t, nodes[1], "watcher", true, nil)
+	defer watcher.Disconnect(0)
+	subscribe(t, watcher, "$rocketmqtt/#", &r)
+	subscribed(t, nodes[0].b, takeoverTopic, 1)
+
+	// a forged takeover notice of a client is neither forwarded nor acted on
+	forged := fmt.Sprintf(`{"clientID":"victim","connectedAt":%d,"node":"zzz"}`, time.Now().Add(time.Hour).UnixNano())
+	pub := connect(t, nodes[0], "forger", true, nil)
+	defer pub.Disconnect(0)
+	if tk := pub.Publish(takeoverTopic, 0, false, forged); !tk.WaitTimeout(5 * time.Second) {
+		t.Fatal("publish timeout")
+	}
+
+	select {
+	case <-lost:
+		t.Fatal("client dropped by a notice of another client")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if r.len() != 0 {
+		t.Fatalf("route topic delivered: %v", r.payloads())
+	}
+}
+
+func TestClientPropsDropRouteProps(t *testing.T) {
+	props := &mqtt5.Properties{
+		ContentType: "text/plain",
+		User: []mqtt5.UserProperty{
+			{Key: routeClientProp, Value: "victim"},
+			{Key: "app", Value: "1"},
+			{Key: routeShareProp, Value: "g"},
+			{Key: routeAckProp, Value: "id"},
+		},
+	}
+	got := clientProps(props)
+	if got.ContentType != "text/plain" || len(got.User) != 1 || got.User[0].Key != "app" {
+		t.Fatalf("got %+v", got)
+	}
+	// the properties of the client are left as they are
+	if len(props.User) != 4 {
+		t.Fatalf("client properties changed: %+v", props.User)
+	}
+
+	only := &mqtt5.Properties{User: []mqtt5.UserProperty{{Key: routeClientProp, Value: "victim"}}}
+	if got := clientProps(only); got != nil {
+		t.Fatalf("got %+v, want none", got)
+	}
+}
+
+func TestClusterForwardLoad(t *testing.T) {
+	const total = 5000
+	nodes := startCluster(t, 2, func(cfg *conf.Config) {
+		// the subscriber itself may queue all of them, the route is under test
+		cfg.Broker.MaxQueued = total
+	})
+
+	var r receiver
+	sub := connect(t, nodes[1], "loadsub", true, nil)
+	defer sub.Disconnect(0)
+	subscribe(t, sub, "load/t", &r)
+	subscribed(t, nodes[0].b, "load/t", 1)
+
+	pub := connect(t, nodes[0], "loadpub", true, nil)
+	defer pub.Disconnect(0)
+	tokens := make([]mqtt.Token, total)
+	for i := range tokens {
+		tokens[i] = pub.Publish("load/t", 1, false, fmt.Sprint(i))
+	}
+	for _, tk := range tokens {
+		if !tk.WaitTimeout(10*time.Second) || tk.Error() != nil {
+			t.Fatalf("publish: %v", tk.Error())
+		}
+	}
+
+	waitFor(t, "forwarded messages", func() bool { return r.len() >= total })
+}
+
+func TestClusterClock(t *testing.T) {
+	var cc clusterClock
+	// a peer whose clock is an hour ahead
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	cc.observe(ahead)
+	if at := cc.now(); at <= ahead {
+		t.Fatalf("stamp %d not after the one seen %d", at, ahead)
+	}
+	if a, b := cc.now(), cc.now(); b <= a {
+		t.Fatalf("stamps %d then %d", a, b)
+	}
+
+	// the same stamp on two nodes, both keep the same connection
+	if newer(1, "a", 1, "b") == newer(1, "b", 1, "a") {
+		t.Fatal("equal stamps not ordered by node")
+	}
+	if !newer(2, "a", 1, "b") || newer(1, "b", 2, "a") {
+		t.Fatal("stamps not ordered")
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"reflect"
 	"time"
 
+	"rocketmqtt/broker/lib/mqtt5"
+
 	"github.com/tidwall/gjson"
-	"go.uber.org/zap"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	uuid "github.com/google/uuid"
@@ -102,14 +103,11 @@ func addSubMap(m map[string]uint64, topic string) {
 
 func delSubMap(m map[string]uint64, topic string) uint64 {
 	subNum, exist := m[topic]
-	if exist {
-		if subNum > 1 {
-			m[topic] = subNum - 1
-			return subNum - 1
-		}
-	} else {
-		m[topic] = 0
+	if exist && subNum > 1 {
+		m[topic] = subNum - 1
+		return subNum - 1
 	}
+	delete(m, topic)
 	return 0
 }
 
@@ -140,7 +138,7 @@ func unWrapPublishPacket(packet *packets.PublishPacket) *packets.PublishPacket {
 	return p
 }
 
-func publish(sub *subscription, packet *packets.PublishPacket) {
+func publish(sub *subscription, packet *packets.PublishPacket, props *mqtt5.Properties) error {
 	// var p *packets.PublishPacket
 	// if sub.client.info.username != "root" {
 	// 	p = unWrapPublishPacket(packet)
@@ -152,8 +150,6 @@ func publish(sub *subscription, packet *packets.PublishPacket) {
 	// 	log.Error("process message for psub error,  ", zap.Error(err))
 	// }
 
-	err := sub.client.WriterPacket(packet)
-	if err != nil {
-		log.Error("process message for psub error,  ", zap.Error(err))
-	}
+	// the message is delivered with min(publish qos, subscription qos)
+	return sub.client.deliver(packet, props, sub.qos)
 }
@@ -1,6 +1,9 @@
 package broker
 
 import (
+	"rocketmqtt/broker/lib/mqtt5"
+	"rocketmqtt/plugins/bridge"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -13,7 +16,7 @@ func InitHTTPMoniter(b *Broker) {
 		if ok {
 			conn, succss := cli.(*client)
 			if succss {
-				conn.Close()
+				conn.Disconnect(mqtt5.AdministrativeAction)
 				c.JSON(200, map[string]interface{}{
 					"ok":  0,
 					"msg": "closed",
@@ -32,13 +35,17 @@ func InitHTTPMoniter(b *Broker) {
 			conn, succss := cli.(*client)
 			if succss {
 				topics, qos, _ := conn.session.Topics()
+				status := Disconnected
+				if conn.connected() {
+					status = Connected
+				}
 				c.JSON(200, map[string]interface{}{
 					"clientID":  conn.info.clientID,
 					"username":  conn.info.username,
 					"localIP":   conn.info.localIP,
 					"remoteIP":  conn.info.remoteIP,
 					"keepalive": conn.info.keepalive,
-					"status":    conn.status,
+					"status":    status,
 					"topics":    topics,
 					"qos":       qos,
 				})
@@ -73,5 +80,8 @@ func InitHTTPMoniter(b *Broker) {
 			"clients": clients,
 		})
 	})
+	router.GET("api/v1/bridge", func(c *gin.Context) {
+		c.JSON(200, bridge.Delivers.Health())
+	})
 	router.Run(":" + b.config.Listen.ManagePort)
 }
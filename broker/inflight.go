@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"rocketmqtt/broker/lib/mqtt5"
+	"rocketmqtt/broker/lib/sessions"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.uber.org/zap"
+)
+
+const (
+	// DEFAULT_RETRY_INTERVAL is how long an outbound QoS 1/2 message waits for
+	// its ack before being resent
+	DEFAULT_RETRY_INTERVAL = 20 * time.Second
+)
+
+// errors of a message the client didn't get
+var (
+	ErrClientOffline = errors.New("client offline")
+	ErrQueueFull     = errors.New("inflight queue is full")
+)
+
+func copyPublish(packet *packets.PublishPacket, qos byte) *packets.PublishPacket {
+	p := packet.Copy()
+	p.Qos = qos
+	p.Retain = packet.Retain
+	return p
+}
+
+// deliver sends packet to the client at the given qos. QoS 1/2 messages get a
+// message id from the session and stay in its inflight window until acked.
+// props are the MQTT 5 properties of the publisher, nil if there is none.
+// An error means the message was neither written nor kept for later.
+func (c *client) deliver(packet *packets.PublishPacket, props *mqtt5.Properties, qos byte) error {
+	return c.deliverAcked(packet, props, qos, nil)
+}
+
+// deliverAcked is deliver, acked is called once the client acks the QoS 1/2
+// message.
+func (c *client) deliverAcked(packet *packets.PublishPacket, props *mqtt5.Properties, qos byte, acked func()) error {
+	if qos > packet.Qos {
+		qos = packet.Qos
+	}
+
+	m := &sessions.InflightMsg{
+		Packet: copyPublish(packet, qos),
+		Props:  props,
+		Acked:  acked,
+	}
+	if props != nil && props.MessageExpiry != nil {
+		m.Expiry = time.Now().Add(time.Duration(*props.MessageExpiry) * time.Second)
+	}
+
+	if !c.connected() {
+		// only QoS 1/2 messages are kept for the offline client of a persistent session
+		if qos > QosAtMostOnce && c.session != nil && !c.info.cleanSession {
+			if c.session.Inflight().Queue(m) {
+				return nil
+			}
+			log.Warn("offline queue is full, drop message", zap.String("topic", packet.TopicName), zap.String("ClientID", c.info.clientID))
+		}
+		return ErrClientOffline
+	}
+
+	if qos == QosAtMostOnce || c.session == nil {
+		m.Packet.Qos = QosAtMostOnce
+		if err := c.writePublish(m); err != nil {
+			log.Error("process message for psub error,  ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			return err
+		}
+		return nil
+	}
+
+	id, ok, queued := c.session.Inflight().Add(m)
+	if !ok {
+		if !queued {
+			log.Warn("inflight queue is full, drop message", zap.String("topic", packet.TopicName), zap.String("ClientID", c.info.clientID))
+			return ErrQueueFull
+		}
+		// the window may have room left behind messages queued while offline
+		c.sendQueued()
+		return nil
+	}
+
+	if err := c.writePublish(m); err != nil {
+		log.Error("process message for psub error,  ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		// a persistent session resends it once the client is back, a clean
+		// one is gone with the connection
+		if !c.info.cleanSession {
+			return nil
+		}
+		c.session.Inflight().Remove(id)
+		return err
+	}
+	return nil
+}
+
+// writePublish writes the message of m. A MQTT 5 client gets its properties
+// too, with the message expiry interval lowered by the time it waited.
+func (c *client) writePublish(m *sessions.InflightMsg) error {
+	if c.version != mqtt5.Version5 || m.Props == nil {
+		return c.WriterPacket(m.Packet)
+	}
+
+	props := m.Props
+	if !m.Expiry.IsZero() {
+		left := time.Until(m.Expiry).Round(time.Second) / time.Second
+		if left < 0 {
+			left = 0
+		}
+		props = props.Copy()
+		props.MessageExpiry = mqtt5.Uint32(uint32(left))
+	}
+
+	return c.WriterPacketExt(m.Packet, &mqtt5.Ext{Properties: *props})
+}
+
+func (c *client) ProcessPuback(packet *packets.PubackPacket) {
+	if c.session == nil {
+		return
+	}
+	if m, ok := c.session.Inflight().Ack(packet.MessageID); ok {
+		if m.Acked != nil {
+			m.Acked()
+		}
+		c.sendQueued()
+	}
+}
+
+func (c *client) ProcessPubrec(packet *packets.PubrecPacket) {
+	if c.session == nil {
+		return
+	}
+	if !c.session.Inflight().Release(packet.MessageID) {
+		log.Debug("pubrec for unknown message", zap.Uint16("MessageID", packet.MessageID), zap.String("ClientID", c.info.clientID))
+	}
+
+	c.sendPubrel(packet.MessageID)
+}
+
+func (c *client) ProcessPubcomp(packet *packets.PubcompPacket) {
+	if c.session == nil {
+		return
+	}
+	if m, ok := c.session.Inflight().Ack(packet.MessageID); ok {
+		if m.Acked != nil {
+			m.Acked()
+		}
+		c.sendQueued()
+	}
+}
+
+// sendPubrel writes a PUBREL, a resent one included: its flags are always
+// 0010, DUP is only for PUBLISH.
+func (c *client) sendPubrel(messageID uint16) {
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = messageID
+	if err := c.WriterPacket(pubrel); err != nil {
+		log.Error("send pubrel error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+// sendQueued writes the messages that waited for a free slot in the window.
+func (c *client) sendQueued() {
+	for _, m := range c.session.Inflight().Next() {
+		if err := c.writePublish(m); err != nil {
+			log.Error("process message for psub error,  ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			return
+		}
+	}
+}
+
+// resendInflight writes again the messages not acked within timeout, with
+// DUP set, and the PUBREL of the released ones. A zero timeout resends the whole window, as done on reconnect.
+func (c *client) resendInflight(timeout time.Duration) {
+	if !c.connected() || c.session == nil {
+		return
+	}
+
+	for _, m := range c.session.Inflight().Expired(timeout) {
+		if m.Released {
+			c.sendPubrel(m.Packet.MessageID)
+			continue
+		}
+
+		p := copyPublish(m.Packet, m.Packet.Qos)
+		p.MessageID = m.Packet.MessageID
+		p.Dup = true
+		m.Packet = p
+		if err := c.writePublish(&m); err != nil {
+			log.Error("resend message error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			return
+		}
+	}
+}
+
+func (b *Broker) retryInterval() time.Duration {
+	if b.config.Broker.RetryInterval > 0 {
+		return time.Duration(b.config.Broker.RetryInterval) * time.Second
+	}
+	return DEFAULT_RETRY_INTERVAL
+}
+
+// StartRetry periodically resends the unacked outbound messages of every client.
+func (b *Broker) StartRetry() {
+	interval := b.retryInterval()
+	timeTicker := time.NewTicker(interval / 2)
+	for range timeTicker.C {
+		b.clients.Range(func(key, value interface{}) bool {
+			if c, ok := value.(*client); ok {
+				c.resendInflight(interval)
+			}
+			return true
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"time"
 
+	"rocketmqtt/broker/lib/mqtt5"
+
 	simplejson "github.com/bitly/go-simplejson"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"go.uber.org/zap"
@@ -42,12 +44,16 @@ func (c *client) StartPing() {
 
 func (c *client) SendConnect() {
 
-	if c.status != Connected {
+	if !c.connected() {
 		return
 	}
 	m := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
-	m.ProtocolName = "MQIsdp"
-	m.ProtocolVersion = 3
+	m.ProtocolName = "MQTT"
+	m.ProtocolVersion = c.version
+	if m.ProtocolVersion != mqtt5.Version5 {
+		m.ProtocolName = "MQIsdp"
+		m.ProtocolVersion = 3
+	}
 
 	m.CleanSession = true
 	m.ClientIdentifier = c.info.clientID
@@ -0,0 +1,61 @@
+package mqtt5
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Version5 is the protocol level of MQTT 5.0 in the CONNECT packet
+const Version5 byte = 5
+
+// SessionNeverExpires is the session expiry interval of a session kept forever
+const SessionNeverExpires uint32 = 0xFFFFFFFF
+
+// Reason codes used by the broker
+const (
+	Success                     byte = 0x00
+	GrantedQoS1                 byte = 0x01
+	GrantedQoS2                 byte = 0x02
+	DisconnectWithWill          byte = 0x04
+	NoMatchingSubscribers       byte = 0x10
+	NoSubscriptionExisted       byte = 0x11
+	UnspecifiedError            byte = 0x80
+	MalformedPacket             byte = 0x81
+	ProtocolError               byte = 0x82
+	UnsupportedProtocolVersion  byte = 0x84
+	ClientIDNotValid            byte = 0x85
+	BadUsernameOrPassword       byte = 0x86
+	NotAuthorized               byte = 0x87
+	ServerUnavailable           byte = 0x88
+	ServerShuttingDown          byte = 0x8B
+	KeepAliveTimeout            byte = 0x8D
+	SessionTakenOver            byte = 0x8E
+	TopicFilterInvalid          byte = 0x8F
+	TopicNameInvalid            byte = 0x90
+	PacketIDNotFound            byte = 0x92
+	TopicAliasInvalid           byte = 0x94
+	AdministrativeAction        byte = 0x98
+	QoSNotSupported             byte = 0x9B
+	SharedSubNotSupported       byte = 0x9E
+	SubscriptionIDsNotSupported byte = 0xA1
+)
+
+// ConnackCode maps a 3.1.1 CONNACK return code to the MQTT 5 reason code
+func ConnackCode(returnCode byte) byte {
+	switch returnCode {
+	case packets.Accepted:
+		return Success
+	case packets.ErrRefusedBadProtocolVersion:
+		return UnsupportedProtocolVersion
+	case packets.ErrRefusedIDRejected:
+		return ClientIDNotValid
+	case packets.ErrRefusedServerUnavailable:
+		return ServerUnavailable
+	case packets.ErrRefusedBadUsernameOrPassword:
+		return BadUsernameOrPassword
+	case packets.ErrRefusedNotAuthorised:
+		return NotAuthorized
+	case packets.ErrProtocolViolation:
+		return ProtocolError
+	}
+	return UnspecifiedError
+}
@@ -0,0 +1,424 @@
+// Package mqtt5 reads and writes MQTT 5.0 control packets. The packets are
+// decoded into the paho 3.1.1 packet structs the broker already works with,
+// what MQTT 5 adds on top of them (reason codes and properties) is returned
+// aside in an Ext. Connections of an older protocol level are served by paho
+// unchanged.
+package mqtt5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Ext is the MQTT 5 part of a control packet
+type Ext struct {
+	// ReasonCode of CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP and DISCONNECT
+	ReasonCode byte
+	// ReasonCodes of UNSUBACK, SUBACK uses the ReturnCodes of the paho packet
+	ReasonCodes []byte
+	// SubOptions of SUBSCRIBE, one byte per topic. The QoS bits are in the
+	// Qoss of the paho packet as well.
+	SubOptions []byte
+
+	Properties Properties
+	// WillProperties of CONNECT
+	WillProperties Properties
+}
+
+// Props returns the properties of e, nil if e is nil
+func (e *Ext) Props() *Properties {
+	if e == nil {
+		return nil
+	}
+	return &e.Properties
+}
+
+// Validate checks a CONNECT packet like packets.ConnectPacket.Validate does
+// and accepts protocol level 5 as well.
+func Validate(msg *packets.ConnectPacket) byte {
+	if msg.ProtocolVersion != Version5 {
+		return msg.Validate()
+	}
+	if msg.ProtocolName != "MQTT" || msg.ReservedBit != 0 {
+		return packets.ErrProtocolViolation
+	}
+	if len(msg.ClientIdentifier) > 65535 || len(msg.Username) > 65535 || len(msg.Password) > 65535 {
+		return packets.ErrProtocolViolation
+	}
+	return packets.Accepted
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r.Reader, b)
+	return b[0], err
+}
+
+// ReadPacket reads a control packet of a connection at the given protocol
+// level. The level of a CONNECT packet is taken from the packet itself. Ext
+// is nil unless the packet is a MQTT 5 one.
+func ReadPacket(r io.Reader, version byte) (packets.ControlPacket, *Ext, error) {
+	br := byteReader{r}
+	typeAndFlags, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	length, err := decodeVarint(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fh := packets.FixedHeader{
+		MessageType:     typeAndFlags >> 4,
+		Dup:             (typeAndFlags>>3)&0x01 > 0,
+		Qos:             (typeAndFlags >> 1) & 0x03,
+		Retain:          typeAndFlags&0x01 > 0,
+		RemainingLength: length,
+	}
+	cp, err := packets.NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	if fh.MessageType == packets.Connect {
+		version = connectVersion(body)
+	}
+	if version != Version5 {
+		return cp, nil, cp.Unpack(bytes.NewBuffer(body))
+	}
+
+	ext := &Ext{}
+	if err := unpack(cp, ext, bytes.NewBuffer(body)); err != nil {
+		return nil, nil, err
+	}
+	return cp, ext, nil
+}
+
+// connectVersion returns the protocol level of a CONNECT packet body
+func connectVersion(body []byte) byte {
+	if len(body) < 2 {
+		return 0
+	}
+	n := 2 + (int(body[0])<<8 | int(body[1]))
+	if n >= len(body) {
+		return 0
+	}
+	return body[n]
+}
+
+func unpack(cp packets.ControlPacket, ext *Ext, r *bytes.Buffer) error {
+	var err error
+	switch p := cp.(type) {
+	case *packets.ConnectPacket:
+		return unpackConnect(p, ext, r)
+	case *packets.ConnackPacket:
+		var flags byte
+		if flags, err = r.ReadByte(); err != nil {
+			return err
+		}
+		p.SessionPresent = flags&0x01 > 0
+		if ext.ReasonCode, err = r.ReadByte(); err != nil {
+			return err
+		}
+		p.ReturnCode = ext.ReasonCode
+		return ext.Properties.decode(r)
+	case *packets.PublishPacket:
+		if p.TopicName, err = decodeString(r); err != nil {
+			return err
+		}
+		if p.Qos > 0 {
+			if p.MessageID, err = decodeUint16(r); err != nil {
+				return err
+			}
+		}
+		if err = ext.Properties.decode(r); err != nil {
+			return err
+		}
+		p.Payload = make([]byte, r.Len())
+		copy(p.Payload, r.Bytes())
+		return nil
+	case *packets.PubackPacket:
+		p.MessageID, err = unpackAck(ext, r)
+	case *packets.PubrecPacket:
+		p.MessageID, err = unpackAck(ext, r)
+	case *packets.PubrelPacket:
+		p.MessageID, err = unpackAck(ext, r)
+	case *packets.PubcompPacket:
+		p.MessageID, err = unpackAck(ext, r)
+	case *packets.SubscribePacket:
+		if p.MessageID, err = decodeUint16(r); err != nil {
+			return err
+		}
+		if err = ext.Properties.decode(r); err != nil {
+			return err
+		}
+		for r.Len() > 0 {
+			topic, err := decodeString(r)
+			if err != nil {
+				return err
+			}
+			options, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			p.Topics = append(p.Topics, topic)
+			p.Qoss = append(p.Qoss, options&0x03)
+			ext.SubOptions = append(ext.SubOptions, options)
+		}
+	case *packets.SubackPacket:
+		if p.MessageID, err = decodeUint16(r); err != nil {
+			return err
+		}
+		if err = ext.Properties.decode(r); err != nil {
+			return err
+		}
+		p.ReturnCodes = append([]byte(nil), r.Bytes()...)
+	case *packets.UnsubscribePacket:
+		if p.MessageID, err = decodeUint16(r); err != nil {
+			return err
+		}
+		if err = ext.Properties.decode(r); err != nil {
+			return err
+		}
+		for r.Len() > 0 {
+			topic, err := decodeString(r)
+			if err != nil {
+				return err
+			}
+			p.Topics = append(p.Topics, topic)
+		}
+	case *packets.UnsubackPacket:
+		if p.MessageID, err = decodeUint16(r); err != nil {
+			return err
+		}
+		if err = ext.Properties.decode(r); err != nil {
+			return err
+		}
+		ext.ReasonCodes = append([]byte(nil), r.Bytes()...)
+	case *packets.DisconnectPacket:
+		if r.Len() > 0 {
+			if ext.ReasonCode, err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+		if r.Len() > 0 {
+			return ext.Properties.decode(r)
+		}
+	}
+
+	return err
+}
+
+func unpackConnect(p *packets.ConnectPacket, ext *Ext, r *bytes.Buffer) error {
+	var err error
+	if p.ProtocolName, err = decodeString(r); err != nil {
+		return err
+	}
+	if p.ProtocolVersion, err = r.ReadByte(); err != nil {
+		return err
+	}
+	options, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	p.ReservedBit = 1 & options
+	p.CleanSession = 1&(options>>1) > 0
+	p.WillFlag = 1&(options>>2) > 0
+	p.WillQos = 3 & (options >> 3)
+	p.WillRetain = 1&(options>>5) > 0
+	p.PasswordFlag = 1&(options>>6) > 0
+	p.UsernameFlag = 1&(options>>7) > 0
+	if p.Keepalive, err = decodeUint16(r); err != nil {
+		return err
+	}
+	if err = ext.Properties.decode(r); err != nil {
+		return err
+	}
+	if p.ClientIdentifier, err = decodeString(r); err != nil {
+		return err
+	}
+	if p.WillFlag {
+		if err = ext.WillProperties.decode(r); err != nil {
+			return err
+		}
+		if p.WillTopic, err = decodeString(r); err != nil {
+			return err
+		}
+		if p.WillMessage, err = decodeBytes(r); err != nil {
+			return err
+		}
+	}
+	if p.UsernameFlag {
+		if p.Username, err = decodeString(r); err != nil {
+			return err
+		}
+	}
+	if p.PasswordFlag {
+		if p.Password, err = decodeBytes(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackAck decodes PUBACK, PUBREC, PUBREL and PUBCOMP, reason code and
+// properties are left out by the sender when there is nothing to tell.
+func unpackAck(ext *Ext, r *bytes.Buffer) (uint16, error) {
+	id, err := decodeUint16(r)
+	if err != nil {
+		return 0, err
+	}
+	if r.Len() > 0 {
+		if ext.ReasonCode, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	if r.Len() > 0 {
+		err = ext.Properties.decode(r)
+	}
+	return id, err
+}
+
+// WritePacket writes cp as a MQTT 5 control packet with the reason codes and
+// properties of ext, which may be nil.
+func WritePacket(w io.Writer, cp packets.ControlPacket, ext *Ext) error {
+	var body bytes.Buffer
+	var fh *packets.FixedHeader
+
+	switch p := cp.(type) {
+	case *packets.ConnectPacket:
+		fh = &p.FixedHeader
+		body.Write(encodeBytes([]byte("MQTT")))
+		body.WriteByte(Version5)
+		body.WriteByte(boolToByte(p.CleanSession)<<1 | boolToByte(p.WillFlag)<<2 | p.WillQos<<3 |
+			boolToByte(p.WillRetain)<<5 | boolToByte(p.PasswordFlag)<<6 | boolToByte(p.UsernameFlag)<<7)
+		body.Write(encodeUint16(p.Keepalive))
+		body.Write(ext.Props().encode())
+		body.Write(encodeBytes([]byte(p.ClientIdentifier)))
+		if p.WillFlag {
+			var willProps *Properties
+			if ext != nil {
+				willProps = &ext.WillProperties
+			}
+			body.Write(willProps.encode())
+			body.Write(encodeBytes([]byte(p.WillTopic)))
+			body.Write(encodeBytes(p.WillMessage))
+		}
+		if p.UsernameFlag {
+			body.Write(encodeBytes([]byte(p.Username)))
+		}
+		if p.PasswordFlag {
+			body.Write(encodeBytes(p.Password))
+		}
+	case *packets.ConnackPacket:
+		fh = &p.FixedHeader
+		code := ConnackCode(p.ReturnCode)
+		if ext != nil && ext.ReasonCode != Success {
+			code = ext.ReasonCode
+		}
+		body.WriteByte(boolToByte(p.SessionPresent))
+		body.WriteByte(code)
+		body.Write(ext.Props().encode())
+	case *packets.PublishPacket:
+		fh = &p.FixedHeader
+		body.Write(encodeBytes([]byte(p.TopicName)))
+		if p.Qos > 0 {
+			body.Write(encodeUint16(p.MessageID))
+		}
+		body.Write(ext.Props().encode())
+		body.Write(p.Payload)
+	case *packets.PubackPacket:
+		fh = &p.FixedHeader
+		packAck(&body, p.MessageID, ext)
+	case *packets.PubrecPacket:
+		fh = &p.FixedHeader
+		packAck(&body, p.MessageID, ext)
+	case *packets.PubrelPacket:
+		fh = &p.FixedHeader
+		packAck(&body, p.MessageID, ext)
+	case *packets.PubcompPacket:
+		fh = &p.FixedHeader
+		packAck(&body, p.MessageID, ext)
+	case *packets.SubscribePacket:
+		fh = &p.FixedHeader
+		body.Write(encodeUint16(p.MessageID))
+		body.Write(ext.Props().encode())
+		for i, topic := range p.Topics {
+			body.Write(encodeBytes([]byte(topic)))
+			if ext != nil && i < len(ext.SubOptions) {
+				body.WriteByte(ext.SubOptions[i])
+			} else {
+				body.WriteByte(p.Qoss[i])
+			}
+		}
+	case *packets.SubackPacket:
+		fh = &p.FixedHeader
+		body.Write(encodeUint16(p.MessageID))
+		body.Write(ext.Props().encode())
+		body.Write(p.ReturnCodes)
+	case *packets.UnsubscribePacket:
+		fh = &p.FixedHeader
+		body.Write(encodeUint16(p.MessageID))
+		body.Write(ext.Props().encode())
+		for _, topic := range p.Topics {
+			body.Write(encodeBytes([]byte(topic)))
+		}
+	case *packets.UnsubackPacket:
+		if ext == nil {
+			return errors.New("mqtt5: UNSUBACK without reason codes")
+		}
+		fh = &p.FixedHeader
+		body.Write(encodeUint16(p.MessageID))
+		body.Write(ext.Props().encode())
+		body.Write(ext.ReasonCodes)
+	case *packets.PingreqPacket:
+		fh = &p.FixedHeader
+	case *packets.PingrespPacket:
+		fh = &p.FixedHeader
+	case *packets.DisconnectPacket:
+		fh = &p.FixedHeader
+		if ext != nil {
+			body.WriteByte(ext.ReasonCode)
+			body.Write(ext.Props().encode())
+		}
+	default:
+		return fmt.Errorf("mqtt5: unsupported packet %T", cp)
+	}
+
+	fh.RemainingLength = body.Len()
+	var packet bytes.Buffer
+	packet.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain))
+	packet.Write(encodeVarint(fh.RemainingLength))
+	packet.Write(body.Bytes())
+
+	_, err := packet.WriteTo(w)
+	return err
+}
+
+func packAck(body *bytes.Buffer, id uint16, ext *Ext) {
+	body.Write(encodeUint16(id))
+	if ext != nil {
+		body.WriteByte(ext.ReasonCode)
+		body.Write(ext.Props().encode())
+	}
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,385 @@
+package mqtt5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Property identifiers
+const (
+	PropPayloadFormat          byte = 0x01
+	PropMessageExpiry          byte = 0x02
+	PropContentType            byte = 0x03
+	PropResponseTopic          byte = 0x08
+	PropCorrelationData        byte = 0x09
+	PropSubscriptionIdentifier byte = 0x0B
+	PropSessionExpiry          byte = 0x11
+	PropAssignedClientID       byte = 0x12
+	PropServerKeepAlive        byte = 0x13
+	PropAuthMethod             byte = 0x15
+	PropAuthData               byte = 0x16
+	PropRequestProblemInfo     byte = 0x17
+	PropWillDelayInterval      byte = 0x18
+	PropRequestResponseInfo    byte = 0x19
+	PropResponseInfo           byte = 0x1A
+	PropServerReference        byte = 0x1C
+	PropReasonString           byte = 0x1F
+	PropReceiveMaximum         byte = 0x21
+	PropTopicAliasMaximum      byte = 0x22
+	PropTopicAlias             byte = 0x23
+	PropMaximumQoS             byte = 0x24
+	PropRetainAvailable        byte = 0x25
+	PropUser                   byte = 0x26
+	PropMaximumPacketSize      byte = 0x27
+	PropWildcardSubAvailable   byte = 0x28
+	PropSubIDAvailable         byte = 0x29
+	PropSharedSubAvailable     byte = 0x2A
+)
+
+var ErrMalformedProperties = errors.New("mqtt5: malformed properties")
+
+// UserProperty is a name/value pair, the same name may appear more than once
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of a MQTT 5 control packet. Optional numbers are pointers so an
+// absent property can be told from a zero value.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiry          *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQoS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// Copy returns a shallow copy of p, slices are shared.
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+	np := *p
+	return &np
+}
+
+// Forward returns the properties of a PUBLISH that are passed on to the
+// subscribers, nil if there is none of them.
+func (p *Properties) Forward() *Properties {
+	if p == nil {
+		return nil
+	}
+	if p.PayloadFormat == nil && p.MessageExpiry == nil && p.ContentType == "" && p.ResponseTopic == "" &&
+		p.CorrelationData == nil && len(p.User) == 0 {
+		return nil
+	}
+	return &Properties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		User:            p.User,
+	}
+}
+
+// Uint16 and the helpers below return a pointer to v, to fill optional properties
+func Uint16(v uint16) *uint16 { return &v }
+func Uint32(v uint32) *uint32 { return &v }
+func Byte(v byte) *byte       { return &v }
+
+func (p *Properties) encode() []byte {
+	var buf bytes.Buffer
+	if p == nil {
+		buf.Write(encodeVarint(0))
+		return buf.Bytes()
+	}
+
+	var body bytes.Buffer
+	writeByte := func(id byte, v *byte) {
+		if v != nil {
+			body.WriteByte(id)
+			body.WriteByte(*v)
+		}
+	}
+	writeUint16 := func(id byte, v *uint16) {
+		if v != nil {
+			body.WriteByte(id)
+			body.Write(encodeUint16(*v))
+		}
+	}
+	writeUint32 := func(id byte, v *uint32) {
+		if v != nil {
+			body.WriteByte(id)
+			body.Write(encodeUint32(*v))
+		}
+	}
+	writeString := func(id byte, v string) {
+		if v != "" {
+			body.WriteByte(id)
+			body.Write(encodeBytes([]byte(v)))
+		}
+	}
+	writeBinary := func(id byte, v []byte) {
+		if v != nil {
+			body.WriteByte(id)
+			body.Write(encodeBytes(v))
+		}
+	}
+
+	writeByte(PropPayloadFormat, p.PayloadFormat)
+	writeUint32(PropMessageExpiry, p.MessageExpiry)
+	writeString(PropContentType, p.ContentType)
+	writeString(PropResponseTopic, p.ResponseTopic)
+	writeBinary(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		body.WriteByte(PropSubscriptionIdentifier)
+		body.Write(encodeVarint(id))
+	}
+	writeUint32(PropSessionExpiry, p.SessionExpiry)
+	writeString(PropAssignedClientID, p.AssignedClientID)
+	writeUint16(PropServerKeepAlive, p.ServerKeepAlive)
+	writeString(PropAuthMethod, p.AuthMethod)
+	writeBinary(PropAuthData, p.AuthData)
+	writeByte(PropRequestProblemInfo, p.RequestProblemInfo)
+	writeUint32(PropWillDelayInterval, p.WillDelayInterval)
+	writeByte(PropRequestResponseInfo, p.RequestResponseInfo)
+	writeString(PropResponseInfo, p.ResponseInfo)
+	writeString(PropServerReference, p.ServerReference)
+	writeString(PropReasonString, p.ReasonString)
+	writeUint16(PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16(PropTopicAlias, p.TopicAlias)
+	writeByte(PropMaximumQoS, p.MaximumQoS)
+	writeByte(PropRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		body.WriteByte(PropUser)
+		body.Write(encodeBytes([]byte(u.Key)))
+		body.Write(encodeBytes([]byte(u.Value)))
+	}
+	writeUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+	writeByte(PropWildcardSubAvailable, p.WildcardSubAvailable)
+	writeByte(PropSubIDAvailable, p.SubIDAvailable)
+	writeByte(PropSharedSubAvailable, p.SharedSubAvailable)
+
+	buf.Write(encodeVarint(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func (p *Properties) decode(r *bytes.Buffer) error {
+	length, err := decodeVarint(r)
+	if err != nil {
+		return err
+	}
+	if length > r.Len() {
+		return ErrMalformedProperties
+	}
+
+	body := bytes.NewBuffer(r.Next(length))
+	for body.Len() > 0 {
+		id, err := body.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case PropPayloadFormat:
+			p.PayloadFormat, err = decodeBytePtr(body)
+		case PropMessageExpiry:
+			p.MessageExpiry, err = decodeUint32Ptr(body)
+		case PropContentType:
+			p.ContentType, err = decodeString(body)
+		case PropResponseTopic:
+			p.ResponseTopic, err = decodeString(body)
+		case PropCorrelationData:
+			p.CorrelationData, err = decodeBytes(body)
+		case PropSubscriptionIdentifier:
+			var v int
+			v, err = decodeVarint(body)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, v)
+		case PropSessionExpiry:
+			p.SessionExpiry, err = decodeUint32Ptr(body)
+		case PropAssignedClientID:
+			p.AssignedClientID, err = decodeString(body)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = decodeUint16Ptr(body)
+		case PropAuthMethod:
+			p.AuthMethod, err = decodeString(body)
+		case PropAuthData:
+			p.AuthData, err = decodeBytes(body)
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo, err = decodeBytePtr(body)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = decodeUint32Ptr(body)
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo, err = decodeBytePtr(body)
+		case PropResponseInfo:
+			p.ResponseInfo, err = decodeString(body)
+		case PropServerReference:
+			p.ServerReference, err = decodeString(body)
+		case PropReasonString:
+			p.ReasonString, err = decodeString(body)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = decodeUint16Ptr(body)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = decodeUint16Ptr(body)
+		case PropTopicAlias:
+			p.TopicAlias, err = decodeUint16Ptr(body)
+		case PropMaximumQoS:
+			p.MaximumQoS, err = decodeBytePtr(body)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = decodeBytePtr(body)
+		case PropUser:
+			var u UserProperty
+			if u.Key, err = decodeString(body); err == nil {
+				u.Value, err = decodeString(body)
+			}
+			p.User = append(p.User, u)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = decodeUint32Ptr(body)
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable, err = decodeBytePtr(body)
+		case PropSubIDAvailable:
+			p.SubIDAvailable, err = decodeBytePtr(body)
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable, err = decodeBytePtr(body)
+		default:
+			return fmt.Errorf("mqtt5: unknown property 0x%02x", id)
+		}
+		if err != nil {
+			return ErrMalformedProperties
+		}
+	}
+
+	return nil
+}
+
+func encodeUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func encodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func encodeBytes(field []byte) []byte {
+	return append(encodeUint16(uint16(len(field))), field...)
+}
+
+func encodeVarint(v int) []byte {
+	var b []byte
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func decodeVarint(r io.ByteReader) (int, error) {
+	var v int
+	var multiplier uint
+	for multiplier < 28 {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= int(digit&127) << multiplier
+		if digit&128 == 0 {
+			return v, nil
+		}
+		multiplier += 7
+	}
+	return 0, errors.New("mqtt5: malformed variable byte integer")
+}
+
+func decodeUint16(r *bytes.Buffer) (uint16, error) {
+	if r.Len() < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return binary.BigEndian.Uint16(r.Next(2)), nil
+}
+
+func decodeUint32(r *bytes.Buffer) (uint32, error) {
+	if r.Len() < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return binary.BigEndian.Uint32(r.Next(4)), nil
+}
+
+func decodeBytes(r *bytes.Buffer) ([]byte, error) {
+	length, err := decodeUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, length)
+	copy(b, r.Next(int(length)))
+	return b, nil
+}
+
+func decodeString(r *bytes.Buffer) (string, error) {
+	b, err := decodeBytes(r)
+	return string(b), err
+}
+
+func decodeBytePtr(r *bytes.Buffer) (*byte, error) {
+	v, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func decodeUint16Ptr(r *bytes.Buffer) (*uint16, error) {
+	v, err := decodeUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func decodeUint32Ptr(r *bytes.Buffer) (*uint32, error) {
+	v, err := decodeUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
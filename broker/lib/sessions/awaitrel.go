@@ -0,0 +1,71 @@
+package sessions
+
+import (
+	"sync"
+	"time"
+)
+
+// awaitRelExpiry is how long a QoS 2 publish waits for its PUBREL. A client
+// only reuses the id once it got the PUBCOMP, an older entry is one the
+// client gave up on and must not hold back a new message with the same id.
+var awaitRelExpiry = 5 * time.Minute
+
+// AwaitRel holds the ids of the inbound QoS 2 publishes already forwarded
+// and waiting for the PUBREL of the sender. It lives in the session, so a
+// publish sent again after a reconnect is recognized.
+type AwaitRel struct {
+	mu    sync.Mutex
+	ids   map[uint16]time.Time
+	swept time.Time
+}
+
+func NewAwaitRel() *AwaitRel {
+	return &AwaitRel{ids: make(map[uint16]time.Time), swept: time.Now()}
+}
+
+// Add records that the publish id was forwarded, the expired ids are
+// dropped now and then.
+func (a *AwaitRel) Add(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.ids[id] = now
+	if now.Sub(a.swept) < awaitRelExpiry {
+		return
+	}
+	for i, at := range a.ids {
+		if now.Sub(at) >= awaitRelExpiry {
+			delete(a.ids, i)
+		}
+	}
+	a.swept = now
+}
+
+// Waiting reports whether the publish id was forwarded and still waits for
+// its PUBREL.
+func (a *AwaitRel) Waiting(id uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	at, ok := a.ids[id]
+	if ok && time.Since(at) >= awaitRelExpiry {
+		delete(a.ids, id)
+		return false
+	}
+	return ok
+}
+
+// Release forgets id once its PUBREL is received.
+func (a *AwaitRel) Release(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.ids, id)
+}
+
+// Len is the number of ids waiting.
+func (a *AwaitRel) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.ids)
+}
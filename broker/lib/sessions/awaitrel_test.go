@@ -0,0 +1,36 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAwaitRelExpires(t *testing.T) {
+	defer func(d time.Duration) { awaitRelExpiry = d }(awaitRelExpiry)
+	awaitRelExpiry = 50 * time.Millisecond
+
+	a := NewAwaitRel()
+	a.Add(1)
+	a.Add(2)
+	if !a.Waiting(1) {
+		t.Fatal("1 not waiting")
+	}
+	a.Release(2)
+	if a.Waiting(2) {
+		t.Fatal("2 waiting once released")
+	}
+
+	time.Sleep(2 * awaitRelExpiry)
+	// an expired id doesn't hold back a new publish with the same id
+	if a.Waiting(1) {
+		t.Fatal("1 still waiting once expired")
+	}
+
+	a.Add(3)
+	time.Sleep(2 * awaitRelExpiry)
+	// the next Add drops the ids nobody asked about
+	a.Add(4)
+	if n := a.Len(); n != 1 {
+		t.Fatalf("%d ids waiting, want 1", n)
+	}
+}
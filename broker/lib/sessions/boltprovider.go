@@ -0,0 +1,220 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var _ SessionsProvider = (*boltProvider)(nil)
+
+var sessionsBucket = []byte("sessions")
+
+// boltProvider keeps the sessions in memory like memProvider and writes the
+// persistent ones (see Session.Persistent) to a bbolt file on Save, so they
+// survive a restart of the broker. Queued and inflight messages are not
+// stored, only the CONNECT packet, without the password, and the subscribed
+// topics.
+type boltProvider struct {
+	db *bolt.DB
+	st map[string]*Session
+	mu sync.RWMutex
+}
+
+// sessionRecord is how a session is stored on disk
+type sessionRecord struct {
+	// Connect is the CONNECT packet encoded as on the wire
+	Connect []byte          `json:"connect"`
+	Topics  map[string]byte `json:"topics"`
+	Expiry  uint32          `json:"expiry,omitempty"`
+}
+
+// NewBoltProvider opens (or creates) the session file at path and loads the
+// sessions stored in it.
+func NewBoltProvider(path string) (*boltProvider, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	this := &boltProvider{
+		db: db,
+		st: make(map[string]*Session),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			sess, err := decodeSession(v)
+			if err != nil {
+				// a broken record must not prevent the broker from starting
+				log.Warn("drop stored session", zap.ByteString("id", k), zap.Error(err))
+				return nil
+			}
+			this.st[string(k)] = sess
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *boltProvider) New(id string) (*Session, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := this.delete(id); err != nil {
+		return nil, err
+	}
+
+	this.st[id] = &Session{id: id}
+	return this.st[id], nil
+}
+
+func (this *boltProvider) Get(id string) (*Session, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	sess, ok := this.st[id]
+	if !ok {
+		return nil, fmt.Errorf("store/Get: No session found for key %s", id)
+	}
+
+	return sess, nil
+}
+
+func (this *boltProvider) Del(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.st, id)
+	if err := this.delete(id); err != nil {
+		log.Error("delete stored session error", zap.String("id", id), zap.Error(err))
+	}
+}
+
+func (this *boltProvider) delete(id string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(id))
+	})
+}
+
+// Save writes the session to disk, sessions that end with the connection are
+// never stored.
+func (this *boltProvider) Save(id string) error {
+	sess, err := this.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if !sess.Persistent() {
+		return nil
+	}
+
+	data, err := sess.encode()
+	if err != nil {
+		return err
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(id), data)
+	})
+}
+
+func (this *boltProvider) Count() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return len(this.st)
+}
+
+func (this *boltProvider) Range(f func(id string, sess *Session) bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for id, sess := range this.st {
+		if !f(id, sess) {
+			return
+		}
+	}
+}
+
+func (this *boltProvider) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.st = make(map[string]*Session)
+	return this.db.Close()
+}
+
+func (this *Session) encode() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.initted {
+		return nil, fmt.Errorf("Session not yet initialized")
+	}
+
+	// the password is only needed to authenticate the connection
+	cmsg := *this.cmsg
+	cmsg.PasswordFlag = false
+	cmsg.Password = nil
+
+	var buf bytes.Buffer
+	if err := cmsg.Write(&buf); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&sessionRecord{
+		Connect: buf.Bytes(),
+		Topics:  this.topics,
+		Expiry:  this.expiry,
+	})
+}
+
+func decodeSession(data []byte) (*Session, error) {
+	var record sessionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	packet, err := packets.ReadPacket(bytes.NewReader(record.Connect))
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return nil, fmt.Errorf("stored packet is not a CONNECT")
+	}
+
+	sess := &Session{}
+	if err := sess.Init(msg); err != nil {
+		return nil, err
+	}
+	for topic, qos := range record.Topics {
+		sess.topics[topic] = qos
+	}
+	sess.expiry = record.Expiry
+
+	return sess, nil
+}
@@ -0,0 +1,245 @@
+package sessions
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"rocketmqtt/broker/lib/mqtt5"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// Max number of unacknowledged outbound messages per session
+	defaultMaxInflight = 32
+	// Max number of messages waiting for a free slot in the inflight window
+	defaultMaxQueued = 1000
+)
+
+const (
+	// DropNewest discards the incoming message when the queue is full
+	DropNewest = "newest"
+	// DropOldest discards the head of the queue to make room for the incoming message
+	DropOldest = "oldest"
+)
+
+// InflightMsg is an outbound QoS 1/2 publish waiting for the client to ack it.
+type InflightMsg struct {
+	Packet *packets.PublishPacket
+
+	// Props are the MQTT 5 properties passed on with the message, nil for
+	// messages of 3.1.1 publishers
+	Props *mqtt5.Properties
+
+	// Expiry is when the message expires, zero if it never does
+	Expiry time.Time
+
+	// Released is set once PUBREC is received for a QoS 2 message, from then on
+	// PUBREL is what has to be resent instead of the PUBLISH.
+	Released bool
+
+	// SentAt is the last time the message (or its PUBREL) was written
+	SentAt time.Time
+
+	// Acked is called once the client acks the message, nil if nobody
+	// waits for it
+	Acked func()
+}
+
+// Inflight is the outbound window of a session. It hands out message ids,
+// keeps the messages until they are acked and queues the overflow.
+type Inflight struct {
+	mu sync.Mutex
+
+	nextID uint16
+	max    int
+	msgs   map[uint16]*InflightMsg
+	// ids in the order they were sent, used to resend in order
+	order []uint16
+
+	maxQueued  int
+	dropOldest bool
+	queue      []*InflightMsg
+}
+
+func newInflight() *Inflight {
+	return &Inflight{
+		max:       defaultMaxInflight,
+		maxQueued: defaultMaxQueued,
+		msgs:      make(map[uint16]*InflightMsg),
+	}
+}
+
+// SetLimit changes the size of the inflight window and of the waiting queue,
+// a non positive value keeps the current one. dropPolicy tells which message
+// is discarded once the queue is full, DropNewest when empty.
+func (this *Inflight) SetLimit(maxInflight, maxQueued int, dropPolicy string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if maxInflight > 0 {
+		this.max = maxInflight
+	}
+	// there are no more message ids than that
+	if this.max > math.MaxUint16 {
+		this.max = math.MaxUint16
+	}
+	if maxQueued > 0 {
+		this.maxQueued = maxQueued
+	}
+	this.dropOldest = dropPolicy == DropOldest
+}
+
+// Add stores msg under a new message id and returns it. If the window is full
+// the message is queued instead and ok is false; queued is false as well when
+// the queue is full and the message has been dropped.
+func (this *Inflight) Add(msg *InflightMsg) (id uint16, ok bool, queued bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// keep the order, nothing skips the messages already waiting
+	if len(this.msgs) >= this.max || len(this.queue) > 0 {
+		return 0, false, this.enqueue(msg)
+	}
+
+	return this.add(msg), true, false
+}
+
+// Queue appends msg to the waiting queue without sending it, it's used while
+// the client of a persistent session is offline.
+func (this *Inflight) Queue(msg *InflightMsg) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.enqueue(msg)
+}
+
+func (this *Inflight) enqueue(msg *InflightMsg) bool {
+	if len(this.queue) >= this.maxQueued {
+		if !this.dropOldest {
+			return false
+		}
+		this.queue[0] = nil
+		this.queue = this.queue[1:]
+	}
+
+	this.queue = append(this.queue, msg)
+	return true
+}
+
+func (this *Inflight) add(msg *InflightMsg) uint16 {
+	for {
+		this.nextID++
+		if this.nextID == 0 {
+			this.nextID = 1
+		}
+		if _, exist := this.msgs[this.nextID]; !exist {
+			break
+		}
+	}
+
+	msg.Packet.MessageID = this.nextID
+	msg.SentAt = time.Now()
+	this.msgs[this.nextID] = msg
+	this.order = append(this.order, this.nextID)
+
+	return this.nextID
+}
+
+// Ack removes the message with id from the window and returns it, it's
+// called on PUBACK for QoS 1 and PUBCOMP for QoS 2.
+func (this *Inflight) Ack(id uint16) (*InflightMsg, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	m, ok := this.msgs[id]
+	if !ok {
+		return nil, false
+	}
+
+	delete(this.msgs, id)
+	for i, v := range this.order {
+		if v == id {
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			break
+		}
+	}
+
+	return m, true
+}
+
+// Remove takes the message with id out of the window without an ack, it's
+// used when the message could not be written.
+func (this *Inflight) Remove(id uint16) bool {
+	_, ok := this.Ack(id)
+	return ok
+}
+
+// Release marks the QoS 2 message with id as received by the client.
+func (this *Inflight) Release(id uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	m, ok := this.msgs[id]
+	if !ok {
+		return false
+	}
+
+	m.Released = true
+	m.SentAt = time.Now()
+
+	return true
+}
+
+// Next moves queued messages into the free slots of the window and returns
+// them, they already carry their new message id. Messages that expired while
+// queued are dropped.
+func (this *Inflight) Next() []*InflightMsg {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var msgs []*InflightMsg
+	now := time.Now()
+	for len(this.queue) > 0 && len(this.msgs) < this.max {
+		msg := this.queue[0]
+		this.queue[0] = nil
+		this.queue = this.queue[1:]
+
+		if !msg.Expiry.IsZero() && now.After(msg.Expiry) {
+			continue
+		}
+		this.add(msg)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+// Expired returns, in send order, the messages not acked since timeout and
+// marks them as sent now. A zero timeout returns all of them.
+func (this *Inflight) Expired(timeout time.Duration) []InflightMsg {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var msgs []InflightMsg
+	now := time.Now()
+	for _, id := range this.order {
+		m := this.msgs[id]
+		if now.Sub(m.SentAt) < timeout {
+			continue
+		}
+		m.SentAt = now
+		msgs = append(msgs, *m)
+	}
+
+	return msgs
+}
+
+// Len returns the number of messages in the window and in the queue.
+func (this *Inflight) Len() (int, int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.msgs), len(this.queue)
+}
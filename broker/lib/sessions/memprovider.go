@@ -56,6 +56,17 @@ func (this *memProvider) Count() int {
 	return len(this.st)
 }
 
+func (this *memProvider) Range(f func(id string, sess *Session) bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for id, sess := range this.st {
+		if !f(id, sess) {
+			return
+		}
+	}
+}
+
 func (this *memProvider) Close() error {
 	this.st = make(map[string]*Session)
 	return nil
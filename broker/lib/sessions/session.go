@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"sync"
 
+	"rocketmqtt/broker/lib/mqtt5"
+
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -26,6 +28,15 @@ type Session struct {
 	// topics stores all the topis for this session/client
 	topics map[string]byte
 
+	// inflight holds the outbound QoS 1/2 messages not yet acked by the client
+	inflight *Inflight
+
+	// awaitRel holds the inbound QoS 2 publishes waiting for their PUBREL
+	awaitRel *AwaitRel
+
+	// expiry is the session expiry interval in seconds of a MQTT 5 client
+	expiry uint32
+
 	// Initialized?
 	initted bool
 
@@ -55,6 +66,10 @@ func (this *Session) Init(msg *packets.ConnectPacket) error {
 
 	this.topics = make(map[string]byte, 1)
 
+	this.inflight = newInflight()
+
+	this.awaitRel = NewAwaitRel()
+
 	this.id = string(msg.ClientIdentifier)
 
 	this.initted = true
@@ -126,10 +141,31 @@ func (this *Session) Topics() ([]string, []byte, error) {
 	return topics, qoss, nil
 }
 
+func (this *Session) Inflight() *Inflight {
+	return this.inflight
+}
+
+func (this *Session) AwaitRel() *AwaitRel {
+	return this.awaitRel
+}
+
 func (this *Session) ID() string {
 	return this.cmsg.ClientIdentifier
 }
 
+// ProtocolVersion is the protocol level of the CONNECT of the session
+func (this *Session) ProtocolVersion() byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.cmsg.ProtocolVersion
+}
+
+func (this *Session) Username() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.cmsg.Username
+}
+
 func (this *Session) WillFlag() bool {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -147,3 +183,26 @@ func (this *Session) CleanSession() bool {
 	defer this.mu.Unlock()
 	return this.cmsg.CleanSession
 }
+
+func (this *Session) SetExpiry(v uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.expiry = v
+}
+
+func (this *Session) Expiry() uint32 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.expiry
+}
+
+// Persistent reports whether the session outlives the connection, that is
+// CleanSession=0 for 3.1.1 and a non zero session expiry interval for MQTT 5.
+func (this *Session) Persistent() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.cmsg.ProtocolVersion == mqtt5.Version5 {
+		return this.expiry > 0
+	}
+	return !this.cmsg.CleanSession
+}
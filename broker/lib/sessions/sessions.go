@@ -24,6 +24,8 @@ type SessionsProvider interface {
 	Del(id string)
 	Save(id string) error
 	Count() int
+	// Range calls f for each session until it returns false
+	Range(f func(id string, sess *Session) bool)
 	Close() error
 }
 
@@ -82,6 +84,10 @@ func (this *Manager) Count() int {
 	return this.p.Count()
 }
 
+func (this *Manager) Range(f func(id string, sess *Session) bool) {
+	this.p.Range(f)
+}
+
 func (this *Manager) Close() error {
 	return this.p.Close()
 }
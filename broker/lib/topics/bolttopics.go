@@ -0,0 +1,173 @@
+package topics
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var _ TopicsProvider = (*boltTopics)(nil)
+
+var retainedBucket = []byte("retained")
+
+// boltTopics keeps subscriptions and retained messages in memory like
+// memTopics, retained messages are also written to a bbolt file in the
+// background and loaded back when the provider is created.
+type boltTopics struct {
+	*memTopics
+	db *bolt.DB
+
+	mu sync.Mutex
+	// pending are the retained messages not written yet, the last one of a
+	// topic wins, all of them go in one transaction
+	pending map[string]*packets.PublishPacket
+	wake    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewBoltProvider opens (or creates) the retained message file at path and
+// loads the messages stored in it.
+func NewBoltProvider(path string) (*boltTopics, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	this := &boltTopics{
+		memTopics: NewMemProvider(),
+		db:        db,
+		pending:   make(map[string]*packets.PublishPacket),
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(retainedBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			msg, err := decodeRetained(v)
+			if err != nil {
+				log.Warn("drop stored retained message", zap.ByteString("topic", k), zap.Error(err))
+				return nil
+			}
+			return this.memTopics.Retain(msg)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go this.writer()
+	return this, nil
+}
+
+func (this *boltTopics) Retain(msg *packets.PublishPacket) error {
+	// keep a copy, the packet of the publisher is written to other clients
+	retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	retained.TopicName = msg.TopicName
+	retained.Payload = msg.Payload
+	retained.Qos = msg.Qos
+	retained.Retain = true
+
+	if err := this.memTopics.Retain(retained); err != nil {
+		return err
+	}
+
+	// the publisher doesn't wait for the disk
+	this.mu.Lock()
+	this.pending[retained.TopicName] = retained
+	this.mu.Unlock()
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writer writes the pending messages until the provider is closed
+func (this *boltTopics) writer() {
+	defer close(this.done)
+	for {
+		select {
+		case <-this.wake:
+			this.flush()
+		case <-this.quit:
+			this.flush()
+			return
+		}
+	}
+}
+
+func (this *boltTopics) flush() {
+	this.mu.Lock()
+	pending := this.pending
+	this.pending = make(map[string]*packets.PublishPacket)
+	this.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	err := this.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(retainedBucket)
+		for topic, msg := range pending {
+			// an empty payload deletes the retained message, see memTopics.Retain
+			if len(msg.Payload) == 0 {
+				if err := bucket.Delete([]byte(topic)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			var buf bytes.Buffer
+			if err := msg.Write(&buf); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(topic), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("write retained messages error", zap.Int("count", len(pending)), zap.Error(err))
+	}
+}
+
+// Close writes the pending messages and closes the file. The messages stay
+// in memory for the clients still connected until the broker exits.
+func (this *boltTopics) Close() error {
+	close(this.quit)
+	<-this.done
+	return this.db.Close()
+}
+
+func decodeRetained(data []byte) (*packets.PublishPacket, error) {
+	packet, err := packets.ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := packet.(*packets.PublishPacket)
+	if !ok {
+		return nil, fmt.Errorf("stored packet is not a PUBLISH")
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,44 @@
+package topics
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// TestBoltRetainedWrittenOnClose checks the retained messages still waiting
+// for the writer are on disk once the provider is closed.
+func TestBoltRetainedWrittenOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topics.db")
+	p, err := NewBoltProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 100
+	for i := 0; i < total; i++ {
+		msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		msg.TopicName = fmt.Sprint("r/", i)
+		msg.Payload = []byte("v")
+		if err := p.Retain(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewBoltProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var msgs []*packets.PublishPacket
+	if err := p.Retained([]byte("r/+"), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != total {
+		t.Fatalf("got %d retained messages, want %d", len(msgs), total)
+	}
+}
@@ -1,6 +1,70 @@
 package broker
 
-import "github.com/eclipse/paho.mqtt.golang/packets"
+import (
+	"path/filepath"
+	"rocketmqtt/broker/lib/mqtt5"
+	"rocketmqtt/broker/lib/sessions"
+	"rocketmqtt/conf"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.uber.org/zap"
+)
+
+func newSessionManager(store conf.Store) (*sessions.Manager, error) {
+	switch store.Sessions {
+	case "", "mem":
+		return sessions.NewManager("mem")
+	case "bolt":
+		p, err := sessions.NewBoltProvider(filepath.Join(store.DataDir(), "sessions.db"))
+		if err != nil {
+			return nil, err
+		}
+		sessions.Register("bolt", p)
+		return sessions.NewManager("bolt")
+	}
+	return sessions.NewManager(store.Sessions)
+}
+
+// restoreSessions puts the persistent sessions the provider loaded back
+// offline, subscribed as their clients left them, so messages are queued for
+// them until the clients come back. The routes of the peers get them as any
+// offline client once they connect.
+func (b *Broker) restoreSessions() {
+	b.sessionMgr.Range(func(id string, sess *sessions.Session) bool {
+		if !sess.Persistent() {
+			return true
+		}
+
+		c := &client{
+			typ:       CLIENT,
+			broker:    b,
+			status:    Disconnected,
+			session:   sess,
+			subMap:    make(map[string]*subscription),
+			topicsMgr: b.topicsMgr,
+			version:   sess.ProtocolVersion(),
+			info: info{
+				clientID:      id,
+				username:      sess.Username(),
+				sessionExpiry: sess.Expiry(),
+			},
+		}
+		sess.Inflight().SetLimit(b.config.Broker.MaxInflight, b.config.Broker.MaxQueued, b.config.Broker.QueueDropPolicy)
+		c.restoreSubscriptions()
+
+		b.offline.Store(id, c)
+		b.expireSession(c)
+		return true
+	})
+}
+
+// saveSession lets the sessions provider persist the current state of c.
+func (b *Broker) saveSession(c *client) {
+	if err := b.sessionMgr.Save(c.info.clientID); err != nil {
+		log.Error("save session error: ", zap.Error(err), zap.String("clientID", c.info.clientID))
+	}
+}
 
 func (b *Broker) getSession(cli *client, req *packets.ConnectPacket, resp *packets.ConnackPacket) error {
 	// If CleanSession is set to 0, the server MUST resume communications with the
@@ -49,5 +113,73 @@ func (b *Broker) getSession(cli *client, req *packets.ConnectPacket, resp *packe
 		}
 	}
 
+	cli.session.SetExpiry(cli.info.sessionExpiry)
+	// a QoS 2 publish sent again after a reconnect is still known
+	cli.awaitRel = cli.session.AwaitRel()
+
+	// a MQTT 5 client may accept less messages at once than configured
+	maxInflight := b.config.Broker.MaxInflight
+	if rm := int(cli.info.receiveMaximum); rm > 0 && (maxInflight <= 0 || rm < maxInflight) {
+		maxInflight = rm
+	}
+	if cli.typ == ROUTER {
+		cli.session.Inflight().SetLimit(b.routeLimits())
+	} else {
+		cli.session.Inflight().SetLimit(maxInflight, b.config.Broker.MaxQueued, b.config.Broker.QueueDropPolicy)
+	}
+	b.saveSession(cli)
+
 	return nil
 }
+
+// removeSession discards the clean session of c once it disconnects, unless a
+// new connection with the same client id has replaced it already.
+func (b *Broker) removeSession(c *client) {
+	if c.session == nil {
+		return
+	}
+	if s, err := b.sessionMgr.Get(c.info.clientID); err == nil && s == c.session {
+		b.sessionMgr.Del(c.info.clientID)
+	}
+}
+
+// takeOffline removes the offline client of a persistent session from
+// b.offline, so that its session is not expired any more.
+func (b *Broker) takeOffline(cid string) (*client, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	off, ok := b.offline.Load(cid)
+	if !ok {
+		return nil, false
+	}
+	b.offline.Delete(cid)
+
+	c, ok := off.(*client)
+	return c, ok
+}
+
+// expireSession discards the session of an offline MQTT 5 client once its
+// session expiry interval has elapsed, unless the client came back before.
+func (b *Broker) expireSession(c *client) {
+	if c.version != mqtt5.Version5 || c.info.sessionExpiry == mqtt5.SessionNeverExpires {
+		return
+	}
+
+	time.AfterFunc(time.Duration(c.info.sessionExpiry)*time.Second, func() {
+		b.mu.Lock()
+		off, ok := b.offline.Load(c.info.clientID)
+		if !ok || off != c {
+			b.mu.Unlock()
+			return
+		}
+		b.offline.Delete(c.info.clientID)
+		b.mu.Unlock()
+
+		log.Debug("session expired", zap.String("clientID", c.info.clientID))
+		c.unsubscribeLocal()
+		b.BroadcastUnSubscribe(c.subMap)
+		b.BroadcastRelease(c)
+		b.removeSession(c)
+	})
+}
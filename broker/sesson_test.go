@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rocketmqtt/broker/lib/sessions"
+	"rocketmqtt/broker/lib/topics"
+	"rocketmqtt/conf"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// startBoltNode starts a single broker whose sessions are in the bolt file
+// at path.
+func startBoltNode(t *testing.T, path string) *node {
+	t.Helper()
+	conf.RunConfig = &conf.Config{}
+
+	clusterSeq++
+	store := "bolt" + strconv.Itoa(clusterSeq)
+	p, err := sessions.NewBoltProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.Register(store, p)
+	topics.Register(store, topics.NewMemProvider())
+
+	cfg := &conf.Config{}
+	cfg.Broker.ID = store
+	cfg.Listen.Host = "127.0.0.1"
+	cfg.Listen.Port = freePort(t)
+	cfg.Store.Sessions = store
+	cfg.Store.Topics = store
+
+	b, err := NewBroker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.auth = nil
+	b.Start()
+
+	hp := "127.0.0.1:" + cfg.Listen.Port
+	waitFor(t, "listener", func() bool {
+		conn, err := net.Dial("tcp", hp)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+	nd := &node{b: b, addr: "tcp://" + hp}
+	closeAtEnd(t, nd)
+	return nd
+}
+
+// TestParkRestoredSession checks a message sent to the client of a session
+// restored from bolt waits in its offline queue, as the park policy of the
+// rocketmq downlinks expects.
+func TestParkRestoredSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+
+	first := startBoltNode(t, path)
+	c := connect(t, first, "parked", false, nil)
+	var r receiver
+	subscribe(t, c, "park/t", &r)
+	c.Disconnect(100)
+	waitFor(t, "offline session", func() bool {
+		_, ok := first.b.offline.Load("parked")
+		return ok
+	})
+	// the file is the one of the next run
+	first.b.sessionMgr.Close()
+
+	second := startBoltNode(t, path)
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "park/t"
+	packet.Qos = 1
+	packet.Payload = []byte("parked")
+	queued := false
+	if forwarded, err := second.b.PublishMessageByCidAcked("parked", packet, nil, func() { queued = true }); err != nil || forwarded || !queued {
+		t.Fatalf("park: forwarded %v, queued %v, %v", forwarded, queued, err)
+	}
+
+	// the queued message comes with the session, before any subscribe
+	opts := mqtt.NewClientOptions().
+		AddBroker(second.addr).
+		SetClientID("parked").
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetDefaultPublishHandler(r.handle)
+	back := mqtt.NewClient(opts)
+	if tk := back.Connect(); !tk.WaitTimeout(5*time.Second) || tk.Error() != nil {
+		t.Fatalf("connect: %v", tk.Error())
+	}
+	defer back.Disconnect(0)
+	waitFor(t, "parked message", func() bool { return r.len() == 1 })
+	if got := r.payloads()[0]; got != "parked" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// rawConnect opens a bare MQTT 3.1.1 connection of a persistent session, to
+// send the packets a client library doesn't let a test choose.
+func rawConnect(t *testing.T, nd *node, cid string) (net.Conn, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(nd.addr, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = cid
+	cp.Keepalive = 30
+	writeRaw(t, conn, cp)
+	ack, ok := readRaw(t, conn).(*packets.ConnackPacket)
+	if !ok || ack.ReturnCode != packets.Accepted {
+		t.Fatalf("connack %v", ack)
+	}
+	return conn, ack
+}
+
+func writeRaw(t *testing.T, conn net.Conn, p packets.ControlPacket) {
+	t.Helper()
+	if err := p.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRaw(t *testing.T, conn net.Conn) packets.ControlPacket {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func rawPublishQos2(t *testing.T, conn net.Conn, id uint16, payload string, dup bool) {
+	t.Helper()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "qos2/t"
+	pub.Qos = 2
+	pub.Dup = dup
+	pub.MessageID = id
+	pub.Payload = []byte(payload)
+	writeRaw(t, conn, pub)
+	if rec, ok := readRaw(t, conn).(*packets.PubrecPacket); !ok || rec.MessageID != id {
+		t.Fatalf("got %v, want the pubrec of %d", rec, id)
+	}
+}
+
+// TestQos2ResentAfterReconnect checks a QoS 2 publish sent again on a new
+// connection of the session, its PUBREL still due, is not forwarded twice.
+func TestQos2ResentAfterReconnect(t *testing.T) {
+	nd := startBoltNode(t, filepath.Join(t.TempDir(), "sessions.db"))
+
+	var r receiver
+	sub := connect(t, nd, "qos2sub", true, nil)
+	defer sub.Disconnect(0)
+	subscribe(t, sub, "qos2/t", &r)
+
+	first, _ := rawConnect(t, nd, "qos2pub")
+	rawPublishQos2(t, first, 7, "once", false)
+	first.Close()
+	waitFor(t, "message", func() bool { return r.len() == 1 })
+	waitFor(t, "offline session", func() bool {
+		_, ok := nd.b.offline.Load("qos2pub")
+		return ok
+	})
+
+	second, ack := rawConnect(t, nd, "qos2pub")
+	defer second.Close()
+	if !ack.SessionPresent {
+		t.Fatal("session not present")
+	}
+	// the PUBREC was lost with the first connection, the client sends again
+	rawPublishQos2(t, second, 7, "once", true)
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 7
+	writeRaw(t, second, rel)
+	if comp, ok := readRaw(t, second).(*packets.PubcompPacket); !ok || comp.MessageID != 7 {
+		t.Fatalf("got %v, want the pubcomp of 7", comp)
+	}
+
+	// once released the id carries a new message
+	rawPublishQos2(t, second, 7, "again", false)
+	waitFor(t, "second message", func() bool { return r.len() == 2 })
+	if got := r.payloads(); got[0] != "once" || got[1] != "again" {
+		t.Fatalf("got %v", got)
+	}
+}
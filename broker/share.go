@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"rocketmqtt/broker/lib/mqtt5"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/segmentio/fasthash/fnv1a"
+	"go.uber.org/zap"
+)
+
+// strategies to pick the member of a share group a message goes to
+const (
+	ShareRandom       = "random"
+	ShareRoundRobin   = "round_robin"
+	ShareSticky       = "sticky"
+	ShareHashClientID = "hash_clientid"
+	ShareHashTopic    = "hash_topic"
+)
+
+// shareGroups keeps what the strategies need to remember per share group
+type shareGroups struct {
+	mu sync.Mutex
+	// next member index of each group, for round_robin
+	next map[string]uint64
+	// client id of the member each group sticks to, for sticky
+	sticky map[string]string
+}
+
+func newShareGroups() *shareGroups {
+	return &shareGroups{
+		next:   make(map[string]uint64),
+		sticky: make(map[string]string),
+	}
+}
+
+// pick returns the index in members of the one to deliver to first, members
+// are sorted by client id.
+func (g *shareGroups) pick(strategy, group string, members []*subscription, publisherID, topic string) int {
+	n := len(members)
+	switch strategy {
+	case ShareRoundRobin:
+		g.mu.Lock()
+		i := g.next[group]
+		g.next[group] = i + 1
+		g.mu.Unlock()
+		return int(i % uint64(n))
+	case ShareSticky:
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if cid, ok := g.sticky[group]; ok {
+			for i, s := range members {
+				if s.client.info.clientID == cid && s.client.connected() {
+					return i
+				}
+			}
+		}
+		i := rand.Intn(n)
+		g.sticky[group] = members[i].client.info.clientID
+		return i
+	case ShareHashClientID:
+		return int(fnv1a.HashString64(publisherID) % uint64(n))
+	case ShareHashTopic:
+		return int(fnv1a.HashString64(topic) % uint64(n))
+	}
+	return rand.Intn(n)
+}
+
+// dispatch delivers packet to every plain subscription in subs and to one
+// member of each share group. A message of this node (forward set) also goes,
+// once, to each route with matching subscriptions, along with the share
+// groups that route is left to deliver to. shared, when not nil, limits the
+// share groups delivered to, as for a message forwarded by another node.
+func (b *Broker) dispatch(subs []interface{}, packet *packets.PublishPacket, props *mqtt5.Properties, publisherID string, forward bool, shared map[string]bool) {
+	var groups map[string][]*subscription
+	routes := make(map[*client][]string)
+	for _, sub := range subs {
+		s, ok := sub.(*subscription)
+		if !ok {
+			continue
+		}
+		if s.client.typ == ROUTER && !forward {
+			continue
+		}
+		if !s.share {
+			if s.client.typ == ROUTER {
+				// a route gets the message once however many of its topics match
+				if _, exist := routes[s.client]; !exist {
+					routes[s.client] = nil
+				}
+				continue
+			}
+			publish(s, packet, props)
+			continue
+		}
+
+		group := s.groupName + "/" + s.topic
+		if shared != nil && !shared[group] {
+			continue
+		}
+		if groups == nil {
+			groups = make(map[string][]*subscription)
+		}
+		groups[group] = append(groups[group], s)
+	}
+
+	for group, members := range groups {
+		if route := b.shareDeliver(group, members, packet, props, publisherID); route != nil {
+			routes[route] = append(routes[route], group)
+		}
+	}
+
+	for route, groups := range routes {
+		route.forward(packet, props, groups)
+	}
+}
+
+// shareDeliver sends packet to one member of a share group. Members online
+// come first, if the write to the chosen one fails the next one is tried.
+// When the chosen member is another node, its route is returned instead.
+func (b *Broker) shareDeliver(group string, members []*subscription, packet *packets.PublishPacket, props *mqtt5.Properties, publisherID string) *client {
+	var online []*subscription
+	for _, s := range members {
+		if s.client.connected() {
+			online = append(online, s)
+		}
+	}
+	// nobody online, a persistent session may still queue the message
+	if len(online) == 0 {
+		online = members
+	}
+
+	sort.Slice(online, func(i, j int) bool {
+		return online[i].client.info.clientID < online[j].client.info.clientID
+	})
+
+	start := b.shareGroups.pick(b.config.Broker.ShareStrategy, group, online, publisherID, packet.TopicName)
+	for i := range online {
+		s := online[(start+i)%len(online)]
+		if s.client.typ == ROUTER {
+			return s.client
+		}
+		err := publish(s, packet, props)
+		if err == nil {
+			return nil
+		}
+		log.Warn("share group delivery failed, try next member", zap.String("group", group), zap.String("ClientID", s.client.info.clientID), zap.Error(err))
+	}
+	return nil
+}
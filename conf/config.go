@@ -8,8 +8,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"rocketmqtt/logger"
-	"strings"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
@@ -21,10 +21,14 @@ type Config struct {
 	Broker        Broker         `yaml:"broker"`
 	Listen        Listen         `yaml:"listen"`
 	TlsInfo       tlsInfo        `yaml:"tlsInfo"`
+	Store         Store          `yaml:"store"`
+	Cluster       Cluster        `yaml:"cluster"`
 	DeliversRules []DeliversRule `yaml:"deliversRules"`
+	Events        Events         `yaml:"events"`
 	Plugins       struct {
 		Rocketmq []Rocketmq `yaml:"rocketmq"`
 		Kafka    []Kafka    `yaml:"kafka"`
+		Webhook  []Webhook  `yaml:"webhook"`
 	} `yaml:"plugins"`
 	Auth map[string]string `yaml:"auth"`
 }
@@ -34,6 +38,17 @@ type Broker struct {
 	TcpKeepalive int    `default:"125" yaml:"tcpKeepalive"`
 	WorkerNum    int    `default:"1024" yaml:"workerNum"`
 	LogLevel     string `default:"debug" yaml:"logLevel"`
+	// outbound QoS 1/2 window and retransmission, see broker/inflight.go
+	MaxInflight   int `default:"32" yaml:"maxInflight"`
+	MaxQueued     int `default:"1000" yaml:"maxQueued"`
+	RetryInterval int `default:"20" yaml:"retryInterval"`
+	// which message is dropped when the queue is full: newest or oldest
+	QueueDropPolicy string `default:"newest" yaml:"queueDropPolicy"`
+	// topic aliases accepted from a MQTT 5 client, 0 disables them
+	TopicAliasMaximum uint16 `default:"16" yaml:"topicAliasMaximum"`
+	// how a share group picks the member a message goes to: random,
+	// round_robin, sticky, hash_clientid or hash_topic
+	ShareStrategy string `default:"random" yaml:"shareStrategy"`
 }
 
 type Listen struct {
@@ -56,13 +71,71 @@ type tlsInfo struct {
 	KeyFile  string `yaml:"keyFile"`
 }
 
+// Store selects where sessions and retained messages are kept, "mem" (when
+// empty) or "bolt" (a file in Dir, see DataDir)
+type Store struct {
+	Sessions string `yaml:"sessions"`
+	Topics   string `yaml:"topics"`
+	Dir      string `yaml:"dir"`
+}
+
+// DataDir is the directory of the store files, data when Dir is empty
+func (s Store) DataDir() string {
+	if s.Dir == "" {
+		return "data"
+	}
+	return s.Dir
+}
+
+// Cluster is where this node listens for its peers and the address of every
+// other node, each node dials all the others. An empty Host listens on every
+// interface.
+type Cluster struct {
+	Host  string   `yaml:"host"`
+	Port  string   `yaml:"port"`
+	Peers []string `yaml:"peers"`
+	// outbound QoS 1/2 window and queue of the messages forwarded to a
+	// peer, a route carries the messages of every client so it gets its own,
+	// 0 is 1024 messages and 100000 queued
+	MaxInflight int `yaml:"maxInflight"`
+	MaxQueued   int `yaml:"maxQueued"`
+}
+
+// DeliversRule sends the messages of Pattern to a target. Topic, Tag and Key
+// are templates, ${topic[1]} or ${payload.deviceId} in them is taken from
+// the message, see plugins/bridge/rule
 type DeliversRule struct {
-	Pattern   string    `yaml:"pattern"`
-	Plugin    string    `yaml:"plugin"`
-	Target    string    `yaml:"target"`
-	Topic     string    `yaml:"topic"`
-	Tag       string    `yaml:"tag"`
-	NameSplit *[]string `yaml:"-"`
+	Pattern string `yaml:"pattern"`
+	Plugin  string `yaml:"plugin"`
+	Target  string `yaml:"target"`
+	Topic   string `yaml:"topic"`
+	Tag     string `yaml:"tag"`
+	// body of the kafka and rocketmq messages: raw (the payload, when
+	// empty), json or protobuf envelope, see plugins/bridge/envelope.go
+	Format string `yaml:"format"`
+	// payload of a json envelope: base64 (when empty) or string
+	PayloadEncoding string `yaml:"payloadEncoding"`
+	// QoS 1/2 publishes matching the rule are acked to the client only once
+	// the target confirmed the write
+	Confirm bool `yaml:"confirm"`
+	// sql statement filtering and reshaping the messages, its FROM takes
+	// the place of Pattern
+	Sql string `yaml:"sql"`
+	// key of the messages, the client id by default
+	Key string `yaml:"key"`
+}
+
+// Events sends the connect, disconnect, subscribe and unsubscribe events of
+// the clients to a bridge target, each action on its topic. An action with no
+// topic is not sent, no plugin sends none.
+type Events struct {
+	Plugin      string `yaml:"plugin"`
+	Target      string `yaml:"target"`
+	Tag         string `yaml:"tag"`
+	Connect     string `yaml:"connect"`
+	Disconnect  string `yaml:"disconnect"`
+	Subscribe   string `yaml:"subscribe"`
+	Unsubscribe string `yaml:"unsubscribe"`
 }
 
 type Rocketmq struct {
@@ -74,13 +147,147 @@ type Rocketmq struct {
 	SubscribeTag    string `yaml:"subscribeTag"`
 	NameSrv         string `yaml:"nameSrv"`
 	GroupName       string `yaml:"groupName"`
+	// Async sends the messages in the background, in batches of BatchSize
+	// sent after BatchInterval ms at the latest, with at most MaxInFlight
+	// messages queued or being sent
+	Async         bool `yaml:"async"`
+	BatchSize     int  `yaml:"batchSize"`
+	BatchInterval int  `yaml:"batchInterval"`
+	MaxInFlight   int  `yaml:"maxInFlight"`
+	// Orderly sends the messages of a client to the same queue, in order.
+	// Async ones are then sent one by one by Workers goroutines, a batch
+	// can't be routed by client
+	Orderly bool  `yaml:"orderly"`
+	Workers int   `yaml:"workers"`
+	Spool   Spool `yaml:"spool"`
+	// Undelivered is what becomes of a subscribed message the client can't
+	// get: drop consumes it all the same, retry has rocketmq redeliver it
+	// later, deadletter sends it to DeadLetterTopic with the reason, park
+	// sends it at QoS 1 so the offline queue of a persistent session keeps
+	// it, it is retried without one. Empty is drop.
+	Undelivered     string `yaml:"undelivered"`
+	DeadLetterTopic string `yaml:"deadLetterTopic"`
+	// ReceiptTopic, when set, has the subscribed messages sent to a client
+	// at QoS 1 and gets a receipt of each: acked, on this node or the one
+	// the client is connected to, failed, or timeout once ReceiptTimeout
+	// seconds (0 is 30) passed unacked. A message queued for an offline
+	// client gets queued first, and no timeout.
+	ReceiptTopic   string `yaml:"receiptTopic"`
+	ReceiptTimeout int    `yaml:"receiptTimeout"`
 }
 
 type Kafka struct {
-	Name      string   `yaml:"name"`
-	Enable    bool     `yaml:"enable"`
-	Addr      []string `yaml:"addr"`
-	GroupName string   `yaml:"groupName"`
+	Name            string   `yaml:"name"`
+	Enable          bool     `yaml:"enable"`
+	EnableSubscribe bool     `yaml:"enableSubscribe"`
+	SubscribeTopics []string `yaml:"subscribeTopics"`
+	Addr            []string `yaml:"addr"`
+	GroupName       string   `yaml:"groupName"`
+	// kafka version the client speaks, 2.2.0 when empty
+	Version string `yaml:"version"`
+	// acks a write waits for: none, leader (when empty) or all
+	RequiredAcks string `yaml:"requiredAcks"`
+	// none (when empty), gzip, snappy, lz4 or zstd
+	Compression string `yaml:"compression"`
+	// writes each message once per partition, needs requiredAcks all
+	Idempotent bool `yaml:"idempotent"`
+	// a batch is sent once it holds FlushMessages messages or FlushBytes
+	// bytes, or FlushFrequency milliseconds after it began, 0 is no limit
+	FlushMessages  int `yaml:"flushMessages"`
+	FlushBytes     int `yaml:"flushBytes"`
+	FlushFrequency int `yaml:"flushFrequency"`
+	// how the partition of a message is chosen: hash of the message key,
+	// the client id, so the messages of a client keep their order (when
+	// empty), random or roundrobin
+	Partitioner string    `yaml:"partitioner"`
+	TLS         ClientTLS `yaml:"tls"`
+	SASL        SASL      `yaml:"sasl"`
+	Spool       Spool     `yaml:"spool"`
+	// ReceiptTopic, when set, has the subscribed messages sent to a client
+	// at QoS 1 and gets a receipt of each, as the one of rocketmq
+	ReceiptTopic   string `yaml:"receiptTopic"`
+	ReceiptTimeout int    `yaml:"receiptTimeout"`
+}
+
+// ClientTLS is the TLS of a connection the broker makes
+type ClientTLS struct {
+	Enable bool `yaml:"enable"`
+	// CAs the server certificate is checked with, the system ones by default
+	CaFile string `yaml:"caFile"`
+	// certificate and key of the broker, when the server asks for one
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// SASL authenticates a connection the broker makes
+type SASL struct {
+	Enable bool `yaml:"enable"`
+	// PLAIN (when empty), SCRAM-SHA-256 or SCRAM-SHA-512
+	Mechanism string `yaml:"mechanism"`
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+}
+
+// Webhook POSTs the messages of its deliver rules to URL. The body is the
+// JSON of the message, or Template, a text/template of it, see
+// plugins/bridge/webhook.go
+type Webhook struct {
+	Name     string            `yaml:"name"`
+	Enable   bool              `yaml:"enable"`
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Template string            `yaml:"template"`
+	// request timeout, in milliseconds, 0 is 5000
+	Timeout int `yaml:"timeout"`
+	// retries of a failed request, 0 doesn't retry, the wait doubles from
+	// RetryInterval milliseconds (0 is 500) on each one, up to 30 seconds
+	Retries       int `yaml:"retries"`
+	RetryInterval int `yaml:"retryInterval"`
+	// messages waiting to be sent, more are dropped, 0 is 1000
+	QueueSize int `yaml:"queueSize"`
+	// 0 is 1
+	Workers int   `yaml:"workers"`
+	Spool   Spool `yaml:"spool"`
+}
+
+// Spool keeps the messages of a bridge target in a file while the target is
+// down, they are sent in order once it is back
+type Spool struct {
+	Enable bool `yaml:"enable"`
+	// directory of the spool files, spool in the store dir by default
+	Dir string `yaml:"dir"`
+	// bytes of messages kept, more are dropped, 0 is 1GiB
+	MaxSize int64 `yaml:"maxSize"`
+	// seconds a message is kept, older ones are dropped, 0 is a day
+	MaxAge int `yaml:"maxAge"`
+}
+
+// Config builds the tls config of the connection
+func (t ClientTLS) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if t.CaFile != "" {
+		rootPEM, err := ioutil.ReadFile(t.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rootPEM) {
+			return nil, fmt.Errorf("failed to parse root ca certificate")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
 }
 
 type Auth struct {
@@ -129,10 +336,31 @@ func NewTLSConfig() (*tls.Config, error) {
 	return &config, nil
 }
 
+// File returns the path of name, relative to the working directory or, when
+// it's not there, to the closest parent it is found in, so the tests of a
+// package find conf/ as well.
+func File(name string) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return name
+	}
+	for {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return name
+		}
+		dir = parent
+	}
+}
+
 func init() {
 	logger.Instance, _ = logger.NewDevLogger()
 
-	content, err := ioutil.ReadFile("conf/liumqtt.yaml")
+	content, err := ioutil.ReadFile(File("conf/liumqtt.yaml"))
 	if err != nil {
 		log.Panic(err.Error())
 	}
@@ -167,11 +395,5 @@ func init() {
 
 	}
 
-	for i, deliver := range c.DeliversRules {
-		s := strings.Split(deliver.Pattern, "/")
-		deliver.NameSplit = &s
-		c.DeliversRules[i] = deliver
-	}
-
 	RunConfig = &c
 }
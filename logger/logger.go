@@ -18,6 +18,8 @@ var (
 func init() {
 	encoderCfg.TimeKey = "timestamp"
 	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	// packages initialized before conf get this one, conf sets the level
+	Instance, _ = NewDevLogger()
 }
 
 // NewDevLogger return a logger for dev builds
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -12,9 +13,12 @@ import (
 	"rocketmqtt/metric"
 	"rocketmqtt/plugins/bridge"
 	"runtime"
+	"sync"
+	"time"
 
 	"fmt"
 
+	"github.com/Shopify/sarama"
 	"github.com/apache/rocketmq-client-go/v2"
 	"github.com/apache/rocketmq-client-go/v2/consumer"
 	"github.com/apache/rocketmq-client-go/v2/primitive"
@@ -24,6 +28,8 @@ import (
 
 var (
 	log = logger.Instance.Named("main")
+
+	errNoTopic = errors.New("message without topic")
 )
 
 func main() {
@@ -47,13 +53,19 @@ func main() {
 	b.Start()
 	broker.RunBroker = b
 	for _, rmq := range bridge.Delivers.GetrocketMQClients() {
-		c := rmq.GetProducer()
-		if c != nil {
-			subscribeRmq(c, b, rmq.GetConfig().SubscribeTopic, rmq.GetConfig().SubscribeTag)
+		if rmq.GetProducer() != nil {
+			subscribeRmq(rmq, b)
+		}
+	}
+	for _, k := range bridge.Delivers.GetkafkaClients() {
+		if k.GetConsumer() != nil {
+			subscribeKafka(k, b)
 		}
 	}
 	//go sendTest(b)
 	s := waitForSignal()
+	bridge.Delivers.Close()
+	b.Close()
 	log.Info("signal received, broker closed.", zap.Any("signal", s))
 }
 
@@ -66,39 +78,61 @@ func waitForSignal() os.Signal {
 	return s
 }
 
+// rmqSubscription is a rocketmq target that subscribes
+type rmqSubscription interface {
+	GetProducer() rocketmq.PushConsumer
+	GetConfig() conf.Rocketmq
+	DeadLetter(msg *primitive.MessageExt, reason string) error
+	Receipt(msg *primitive.MessageExt, status, reason string)
+}
+
+// kafkaSubscription is a kafka target that subscribes
+type kafkaSubscription interface {
+	GetConsumer() sarama.ConsumerGroup
+	GetConfig() conf.Kafka
+	Receipt(msg *sarama.ConsumerMessage, clientID, topic, status, reason string)
+}
+
 // subscribe rocketmq, then send to mqtt
-func subscribeRmq(rc rocketmq.PushConsumer, b *broker.Broker, topic string, tag string) {
+func subscribeRmq(rmq rmqSubscription, b *broker.Broker) {
+	rc, cfg := rmq.GetProducer(), rmq.GetConfig()
 	selector := consumer.MessageSelector{}
-	if tag != "" {
+	if cfg.SubscribeTag != "" {
 		selector = consumer.MessageSelector{
 			Type:       consumer.TAG,
-			Expression: tag,
+			Expression: cfg.SubscribeTag,
 		}
 	}
-	err := rc.Subscribe(topic, selector, func(ctx context.Context,
+	//a parked message is sent at QoS 1, the offline queue only keeps those,
+	//and only a QoS 1 message is acked
+	qos := byte(0)
+	if cfg.Undelivered == bridge.UndeliveredPark || cfg.ReceiptTopic != "" {
+		qos = 1
+		log.Info("rocketmq downlink messages sent at qos 1", zap.String("name", cfg.Name),
+			zap.String("undelivered", cfg.Undelivered), zap.String("receiptTopic", cfg.ReceiptTopic))
+	}
+	err := rc.Subscribe(cfg.SubscribeTopic, selector, func(ctx context.Context,
 		msgs ...*primitive.MessageExt) (consumer.ConsumeResult, error) {
-		for i := range msgs {
+		result := consumer.ConsumeSuccess
+		for _, m := range msgs {
 			//tr := time.Now().UnixNano()
-			msgTopic := msgs[i].GetProperty("topic")
-			msgClientId := msgs[i].GetProperty("clientId")
-
-			packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-			packet.TopicName = msgs[i].GetProperty("topic")
-			packet.Qos = 0
-			packet.Payload = msgs[i].Body
-
-			if msgClientId == "" || msgClientId == "-" {
-				b.PublishMessage(packet)
-			} else if msgTopic != "" {
-				b.PublishMessageByCid(msgClientId, packet)
-			} else {
-				log.Warn("can't send message", zap.String("topic", msgTopic),
-					zap.String("clientId", msgClientId), zap.Any("payload", packet.Payload))
+			cid := m.GetProperty("clientId")
+			var rcpt *receipt
+			if cfg.ReceiptTopic != "" && cid != "" && cid != "-" {
+				m := m
+				rcpt = newReceipt(cfg.ReceiptTimeout, func(status, reason string) {
+					rmq.Receipt(m, status, reason)
+				})
+			}
+			err := downlink(b, m.GetProperty("topic"), cid, m.Body, qos, rcpt)
+			if rcpt != nil && err != nil {
+				rcpt.report(bridge.ReceiptFailed, undeliveredReason(err))
+			}
+			if err != nil && undelivered(rmq, m, err) == consumer.ConsumeRetryLater {
+				result = consumer.ConsumeRetryLater
 			}
-			// count downstream
-			broker.CountIncrease(&broker.MessageDownCount)
 		}
-		return consumer.ConsumeSuccess, nil
+		return result, nil
 	})
 	if err != nil {
 		log.Fatal("start producer error: %s", zap.Error(err))
@@ -109,3 +143,189 @@ func subscribeRmq(rc rocketmq.PushConsumer, b *broker.Broker, topic string, tag
 		//os.Exit(-1)
 	}
 }
+
+// undelivered applies the policy of the subscription to message m the
+// client didn't get
+func undelivered(rmq rmqSubscription, m *primitive.MessageExt, err error) consumer.ConsumeResult {
+	cfg := rmq.GetConfig()
+	reason := undeliveredReason(err)
+	log.Warn("downlink message undelivered", zap.String("reason", reason),
+		zap.String("policy", cfg.Undelivered), zap.String("msgId", m.MsgId),
+		zap.String("topic", m.GetProperty("topic")), zap.String("clientId", m.GetProperty("clientId")))
+
+	switch cfg.Undelivered {
+	case bridge.UndeliveredDeadLetter:
+		if err := rmq.DeadLetter(m, reason); err != nil {
+			log.Error("dead letter error", zap.Error(err), zap.String("msgId", m.MsgId))
+			return consumer.ConsumeRetryLater
+		}
+		return consumer.ConsumeSuccess
+	case bridge.UndeliveredRetry, bridge.UndeliveredPark:
+		//a message without topic fails again, rocketmq would redeliver it for nothing
+		if err == errNoTopic {
+			return consumer.ConsumeSuccess
+		}
+		//the client is on no node, let rocketmq redeliver the message
+		//and dead-letter it once out of retries
+		return consumer.ConsumeRetryLater
+	}
+	//dropped
+	return consumer.ConsumeSuccess
+}
+
+// undeliveredReason is the reason property of a dead letter
+func undeliveredReason(err error) string {
+	switch err {
+	case broker.ErrClientOffline:
+		return "client_offline"
+	case broker.ErrQueueFull:
+		return "queue_full"
+	case errNoTopic:
+		return "no_topic"
+	}
+	return "write_failed"
+}
+
+// receipt reports, with send, what became of a message sent to its client:
+// once the final status, queued before it when the client is offline
+type receipt struct {
+	send  func(status, reason string)
+	mu    sync.Mutex
+	done  bool
+	timer *time.Timer
+}
+
+// newReceipt reports a timeout unless another status is reported within
+// timeout seconds, 0 is 30
+func newReceipt(timeout int, send func(status, reason string)) *receipt {
+	r := &receipt{send: send}
+	if timeout <= 0 {
+		timeout = 30
+	}
+	r.timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		r.report(bridge.ReceiptTimeout, "")
+	})
+	return r
+}
+
+func (r *receipt) report(status, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+	r.timer.Stop()
+	r.send(status, reason)
+}
+
+// queued reports the message waits in the queue of its offline client, it
+// doesn't time out then, acked comes once the client is back
+func (r *receipt) queued() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.timer.Stop()
+	r.send(bridge.ReceiptQueued, "")
+}
+
+// downlink publishes a message consumed from the bridge to the mqtt topic at
+// qos, to the one client named by clientId if any. rcpt, if any, is told
+// what became of the message, on this node or the one the client is
+// connected to.
+func downlink(b *broker.Broker, msgTopic, msgClientId string, payload []byte, qos byte, rcpt *receipt) error {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = msgTopic
+	packet.Qos = qos
+	packet.Payload = payload
+
+	if msgClientId == "" || msgClientId == "-" {
+		b.PublishMessage(packet)
+	} else if msgTopic != "" {
+		var acked, queued func()
+		if rcpt != nil {
+			acked = func() { rcpt.report(bridge.ReceiptAcked, "") }
+			queued = rcpt.queued
+		}
+		if _, err := b.PublishMessageByCidAcked(msgClientId, packet, acked, queued); err != nil {
+			return err
+		}
+	} else {
+		log.Warn("can't send message", zap.String("topic", msgTopic),
+			zap.String("clientId", msgClientId), zap.Any("payload", packet.Payload))
+		return errNoTopic
+	}
+	// count downstream
+	broker.CountIncrease(&broker.MessageDownCount)
+	return nil
+}
+
+// kafkaHandler turns the records of a kafka consumer group into mqtt
+// messages, the mqtt topic and clientId come from the record headers
+type kafkaHandler struct {
+	b *broker.Broker
+	k kafkaSubscription
+	//QoS 1 when the receipts need the ack of the client
+	qos byte
+}
+
+func (h *kafkaHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *kafkaHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		var msgTopic, msgClientId string
+		for _, header := range msg.Headers {
+			switch string(header.Key) {
+			case "topic":
+				msgTopic = string(header.Value)
+			case "clientId":
+				msgClientId = string(header.Value)
+			}
+		}
+		var rcpt *receipt
+		if h.qos > 0 && msgClientId != "" && msgClientId != "-" {
+			msg, msgTopic, msgClientId := msg, msgTopic, msgClientId
+			rcpt = newReceipt(h.k.GetConfig().ReceiptTimeout, func(status, reason string) {
+				h.k.Receipt(msg, msgClientId, msgTopic, status, reason)
+			})
+		}
+		//kafka has no redelivery of a single record, the message is dropped
+		if err := downlink(h.b, msgTopic, msgClientId, msg.Value, h.qos, rcpt); err != nil {
+			log.Warn("drop kafka message", zap.Error(err), zap.String("topic", msgTopic),
+				zap.String("clientId", msgClientId), zap.Int64("offset", msg.Offset))
+			if rcpt != nil {
+				rcpt.report(bridge.ReceiptFailed, undeliveredReason(err))
+			}
+		}
+		sess.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// subscribe kafka, then send to mqtt
+func subscribeKafka(k kafkaSubscription, b *broker.Broker) {
+	kc, cfg := k.GetConsumer(), k.GetConfig()
+	topics := cfg.SubscribeTopics
+	handler := &kafkaHandler{b: b, k: k}
+	//only a QoS 1 message is acked
+	if cfg.ReceiptTopic != "" {
+		handler.qos = 1
+		log.Info("kafka downlink messages sent at qos 1", zap.String("name", cfg.Name),
+			zap.String("receiptTopic", cfg.ReceiptTopic))
+	}
+	go func() {
+		for {
+			//returns on a rebalance, join the group again
+			if err := kc.Consume(context.Background(), topics, handler); err != nil {
+				if err == sarama.ErrClosedConsumerGroup {
+					return
+				}
+				log.Error("consume kafka error: ", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
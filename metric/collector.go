@@ -2,6 +2,7 @@ package metric
 
 import (
 	"rocketmqtt/broker"
+	"rocketmqtt/plugins/bridge"
 	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,6 +18,12 @@ type Collector struct {
 	connectionCountMetric        *prometheus.Desc
 	messageDownstreamTotalMetric *prometheus.Desc
 	messageUpstreamTotalMetric   *prometheus.Desc
+	spoolMessagesMetric          *prometheus.Desc
+	spoolBytesMetric             *prometheus.Desc
+	spoolSpooledTotalMetric      *prometheus.Desc
+	spoolReplayedTotalMetric     *prometheus.Desc
+	spoolDroppedTotalMetric      *prometheus.Desc
+	bridgeSendErrorsTotalMetric  *prometheus.Desc
 }
 
 //You must create a constructor for you collector that
@@ -43,6 +50,30 @@ func newCollector() *Collector {
 			"Shows session count",
 			nil, nil,
 		),
+		spoolMessagesMetric: prometheus.NewDesc("rocketmqtt_spool_messages",
+			"Shows messages waiting in the spool of a bridge target",
+			[]string{"target"}, nil,
+		),
+		spoolBytesMetric: prometheus.NewDesc("rocketmqtt_spool_bytes",
+			"Shows bytes waiting in the spool of a bridge target",
+			[]string{"target"}, nil,
+		),
+		spoolSpooledTotalMetric: prometheus.NewDesc("rocketmqtt_spool_spooled_total",
+			"Shows messages spooled while a bridge target was down",
+			[]string{"target"}, nil,
+		),
+		spoolReplayedTotalMetric: prometheus.NewDesc("rocketmqtt_spool_replayed_total",
+			"Shows spooled messages sent to a bridge target once back",
+			[]string{"target"}, nil,
+		),
+		spoolDroppedTotalMetric: prometheus.NewDesc("rocketmqtt_spool_dropped_total",
+			"Shows messages dropped by the spool of a bridge target, full or too old",
+			[]string{"target"}, nil,
+		),
+		bridgeSendErrorsTotalMetric: prometheus.NewDesc("rocketmqtt_bridge_send_errors_total",
+			"Shows messages a bridge target failed to send in the background",
+			[]string{"target"}, nil,
+		),
 	}
 }
 
@@ -56,6 +87,12 @@ func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- collector.connectionCountMetric
 	ch <- collector.messageDownstreamTotalMetric
 	ch <- collector.messageUpstreamTotalMetric
+	ch <- collector.spoolMessagesMetric
+	ch <- collector.spoolBytesMetric
+	ch <- collector.spoolSpooledTotalMetric
+	ch <- collector.spoolReplayedTotalMetric
+	ch <- collector.spoolDroppedTotalMetric
+	ch <- collector.bridgeSendErrorsTotalMetric
 }
 
 //Collect implements required collect function for all promehteus collectors
@@ -74,6 +111,17 @@ func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(collector.connectionCountMetric, prometheus.GaugeValue, connectionCount)
 	ch <- prometheus.MustNewConstMetric(collector.messageDownstreamTotalMetric, prometheus.CounterValue, retrunFloat64(&broker.MessageDownCount))
 	ch <- prometheus.MustNewConstMetric(collector.messageUpstreamTotalMetric, prometheus.CounterValue, retrunFloat64(&broker.MessageUpCount))
+
+	for _, s := range bridge.Delivers.SpoolStats() {
+		ch <- prometheus.MustNewConstMetric(collector.spoolMessagesMetric, prometheus.GaugeValue, float64(s.Messages), s.Target)
+		ch <- prometheus.MustNewConstMetric(collector.spoolBytesMetric, prometheus.GaugeValue, float64(s.Bytes), s.Target)
+		ch <- prometheus.MustNewConstMetric(collector.spoolSpooledTotalMetric, prometheus.CounterValue, float64(s.Spooled), s.Target)
+		ch <- prometheus.MustNewConstMetric(collector.spoolReplayedTotalMetric, prometheus.CounterValue, float64(s.Replayed), s.Target)
+		ch <- prometheus.MustNewConstMetric(collector.spoolDroppedTotalMetric, prometheus.CounterValue, float64(s.Dropped), s.Target)
+	}
+	for target, n := range bridge.Delivers.SendErrors() {
+		ch <- prometheus.MustNewConstMetric(collector.bridgeSendErrorsTotalMetric, prometheus.CounterValue, float64(n), target)
+	}
 }
 
 func retrunFloat64(c *uint64) float64 {
@@ -15,7 +15,7 @@ type aclAuth struct {
 }
 
 func Init() *aclAuth {
-	aclConfig, err := AclConfigLoad("conf/acl.conf")
+	aclConfig, err := AclConfigLoad(conf.File("conf/acl.conf"))
 	if err != nil {
 		log.Panic(err.Error())
 	}
@@ -1,7 +1,10 @@
 package bridge
 
 import (
+	"rocketmqtt/conf"
 	"rocketmqtt/logger"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -30,6 +33,11 @@ type Elements struct {
 	Timestamp int64  `json:"ts"`
 	Size      int32  `json:"size"`
 	Action    string `json:"action"`
+	// of the lifecycle events, see Event
+	IP        string `json:"ip,omitempty"`
+	Keepalive uint16 `json:"keepalive,omitempty"`
+	Qos       byte   `json:"qos,omitempty"`
+	Reason    string `json:"reason,omitempty"`
 }
 
 type BridgeMQ interface {
@@ -38,9 +46,15 @@ type BridgeMQ interface {
 }
 
 func InitBridgeMQ() BridgeMQ {
-	targets.topicBitMap = make(map[string]int64, 1000)
-	targets.clientsMap = make(map[string]*topicMatched, 1000)
-	Delivers.kafkaClients = InitKafka()
-	Delivers.rocketMQClients = InitRocketMQPushConsumer()
+	if err := Delivers.open(); err != nil {
+		log.Fatal("open bridge targets failed: ", zap.Error(err))
+	}
+	//a rule without its target is a config error, not a crash at runtime
+	if err := Delivers.check(conf.RunConfig.DeliversRules); err != nil {
+		log.Fatal("deliver rules error: ", zap.Error(err))
+	}
+	if err := Delivers.checkEvents(&conf.RunConfig.Events); err != nil {
+		log.Fatal("events error: ", zap.Error(err))
+	}
 	return &Delivers
 }
@@ -2,132 +2,226 @@ package bridge
 
 import (
 	"errors"
+	"fmt"
 	"rocketmqtt/conf"
-	"strings"
 
 	"go.uber.org/zap"
 )
 
-const (
-	Kafka = iota
-	Rocketmq
-)
-
 var Delivers deliver
 
-type PublishMessage interface {
-	publish(topics map[string]bool, key string, msg *Elements) error
-}
-
 type deliver struct {
-	rocketMQClients map[string]*rocketMQ
-	kafkaClients    map[string]*kafka
+	// targets of each driver, by name
+	targets map[string]map[string]Target
+	// each deliver rule compiled, in the order of the config
+	rules   []*compiledRule
+	matcher *ruleMatcher
 }
 
-var targets targetMemPool
-
 func (d *deliver) ExistTargets() bool {
-	if d.kafkaClients != nil || d.rocketMQClients != nil {
-		return true
+	for _, ts := range d.targets {
+		if len(ts) > 0 {
+			return true
+		}
 	}
 	return false
 }
 
 func (d *deliver) GetrocketMQClients() map[string]*rocketMQ {
-	return d.rocketMQClients
+	rmqs := make(map[string]*rocketMQ)
+	for name, t := range d.targets[Rocketmq] {
+		if r, ok := unwrap(t).(*rocketMQ); ok {
+			rmqs[name] = r
+		}
+	}
+	return rmqs
 }
 
-func (d *deliver) Publish(e *Elements) error {
+func (d *deliver) GetkafkaClients() map[string]*kafka {
+	kafkas := make(map[string]*kafka)
+	for name, t := range d.targets[Kafka] {
+		if k, ok := unwrap(t).(*kafka); ok {
+			kafkas[name] = k
+		}
+	}
+	return kafkas
+}
 
-	var bitMark int64
+// open opens the targets of every registered driver
+func (d *deliver) open() error {
+	d.targets = make(map[string]map[string]Target)
+	for name, driver := range drivers {
+		ts, err := driver()
+		if err != nil {
+			return err
+		}
+		for tname, t := range ts {
+			st, ok := t.(spoolTarget)
+			if !ok || !st.spoolConfig().Enable {
+				continue
+			}
+			s, err := newSpool(name+"_"+tname, t, st.spoolConfig())
+			if err != nil {
+				return err
+			}
+			ts[tname] = s
+		}
+		d.targets[name] = ts
+	}
+	return nil
+}
 
-	switch e.Action {
-	case Connect:
-		//log.Debug("Connect", zap.String(e.ClientID, e.Action))
-		//if config.ConnectTopic != "" {
-		//	topics[config.ConnectTopic] = true
-		//}
-	case Publish:
-		// foreach regexp map config
-		if v, ok := targets.getMatch(e.Topic); ok {
-			bitMark = v
-		} else {
-			bitMark = 0
-			for _, target := range conf.RunConfig.DeliversRules {
-				match := matchTopicSplit(target.NameSplit, e.Topic)
-				if match {
-					bitMark = bitMark | 1
-				}
-				bitMark = bitMark << 1
+// check makes sure every deliver rule has its target, and compiles the
+// rules
+func (d *deliver) check(rules []conf.DeliversRule) error {
+	d.rules = make([]*compiledRule, len(rules))
+	for i, rule := range rules {
+		name := ruleName(&rule)
+		cr, err := compileRule(&rule)
+		if err != nil {
+			return fmt.Errorf("deliver rule %s: %v", name, err)
+		}
+		d.rules[i] = cr
+		ts, ok := d.targets[rule.Plugin]
+		if !ok {
+			return fmt.Errorf("deliver rule %s: plugin %s not defined", name, rule.Plugin)
+		}
+		if _, ok := ts[rule.Target]; !ok {
+			return fmt.Errorf("deliver rule %s: %s target %s not found or disabled", name, rule.Plugin, rule.Target)
+		}
+		if err := checkFormat(&rule); err != nil {
+			return err
+		}
+	}
+
+	m, err := newRuleMatcher(rules, d.rules)
+	if err != nil {
+		return err
+	}
+	d.matcher = m
+	return nil
+}
+
+// Flush flushes every target
+func (d *deliver) Flush() {
+	for plugin, ts := range d.targets {
+		for name, t := range ts {
+			if err := t.Flush(); err != nil {
+				log.Error("flush target error", zap.String("plugin", plugin), zap.String("target", name), zap.Error(err))
 			}
-			targets.storeClientTopicMatch(e.ClientID, e.Topic, bitMark)
-		}
-	case Subscribe:
-		//log.Debug("Connect", zap.String(e.ClientID, e.Action))
-		//if config.SubscribeTopic != "" {
-		//	topics[config.SubscribeTopic] = true
-		//}
-	case Unsubscribe:
-		//log.Debug("Connect", zap.String(e.ClientID, e.Action))
-		//if config.UnsubscribeTopic != "" {
-		//	topics[config.UnsubscribeTopic] = true
-		//}
-		targets.deleteTopicMatch(e.ClientID)
-	case Disconnect:
-		//log.Debug("Connect", zap.String(e.ClientID, e.Action))
-		//if config.DisconnectTopic != "" {
-		//	topics[config.DisconnectTopic] = true
-		//}
-		targets.deleteTopicMatch(e.ClientID)
-	default:
-		return errors.New("error action: " + e.Topic)
+		}
 	}
-	var err error
-	if bitMark == 0 {
-		log.Warn("No matched deliver rule", zap.String("ClientID", e.ClientID), zap.Any("element", e))
-		return nil
+}
+
+// Close closes every target
+func (d *deliver) Close() {
+	for plugin, ts := range d.targets {
+		for name, t := range ts {
+			if err := t.Close(); err != nil {
+				log.Error("close target error", zap.String("plugin", plugin), zap.String("target", name), zap.Error(err))
+			}
+		}
 	}
-	for i := len(conf.RunConfig.DeliversRules); i >= 0; i-- {
-		bit := bitMark & 1
-		if bit == 1 {
-			dm := conf.RunConfig.DeliversRules[i]
-			switch dm.Plugin {
-			case "kafka":
-				err = Delivers.kafkaClients[dm.Target].publish(dm.Topic, e.ClientID, e)
-			case "rocketmq":
-				err = Delivers.rocketMQClients[dm.Target].publish(dm.Topic, e.ClientID, e, dm.Tag)
-			default:
-				log.Warn("plugin not defined", zap.String("plugin name", dm.Plugin))
+}
+
+// SpoolStats returns the figures of the spool of every target having one
+func (d *deliver) SpoolStats() []SpoolStats {
+	var stats []SpoolStats
+	for _, ts := range d.targets {
+		for _, t := range ts {
+			if s, ok := t.(*spool); ok {
+				stats = append(stats, s.stats())
 			}
 		}
-		bitMark = bitMark >> 1
 	}
-	return err
+	return stats
 }
 
-func match(subTopic []string, topic []string) bool {
-	if len(subTopic) == 0 {
-		return len(topic) == 0
+// SendErrors returns the count of messages sent in the background that
+// failed, for every target counting them, by plugin_name
+func (d *deliver) SendErrors() map[string]uint64 {
+	errs := make(map[string]uint64)
+	for plugin, ts := range d.targets {
+		for name, t := range ts {
+			if c, ok := unwrap(t).(interface{ sendErrors() uint64 }); ok {
+				errs[plugin+"_"+name] = c.sendErrors()
+			}
+		}
 	}
+	return errs
+}
 
-	if len(topic) == 0 {
-		return subTopic[0] == "#"
+// Health returns the health of every target, "ok" or its last error, by
+// plugin/name
+func (d *deliver) Health() map[string]string {
+	health := make(map[string]string)
+	for plugin, ts := range d.targets {
+		for name, t := range ts {
+			status := "ok"
+			if err := t.Health(); err != nil {
+				status = err.Error()
+			}
+			health[plugin+"/"+name] = status
+		}
 	}
+	return health
+}
 
-	if subTopic[0] == "#" {
-		return true
+// Publish sends e to the targets of the rules it matches, the error is the
+// one of a write that had to be confirmed
+func (d *deliver) Publish(e *Elements) error {
+	switch e.Action {
+	case Connect, Subscribe, Unsubscribe, Disconnect:
+		return d.publishEvent(e)
+	case Publish:
+	default:
+		return errors.New("error action: " + e.Topic)
 	}
 
-	if (subTopic[0] == "+") || (subTopic[0] == topic[0]) {
-		return match(subTopic[1:], topic[1:])
+	rules := d.matcher.match(e.Topic)
+	if len(rules) == 0 {
+		log.Warn("No matched deliver rule", zap.String("ClientID", e.ClientID), zap.Any("element", e))
+		return nil
 	}
-	return false
+	var err error
+	for _, i := range rules {
+		if perr := d.publishRule(i, e); perr != nil {
+			err = perr
+		}
+	}
+	return err
 }
 
-// func matchTopic(subTopic string, topic string) bool {
-// 	return match(strings.Split(subTopic, "/"), strings.Split(topic, "/"))
-// }
+// publishRule sends e to the target of deliver rule i, the error is the one
+// of a write that had to be confirmed
+func (d *deliver) publishRule(i int, e *Elements) error {
+	dm := &conf.RunConfig.DeliversRules[i]
+	dm, key, msg, ok := d.rules[i].apply(dm, e)
+	if !ok {
+		return nil
+	}
+	if dm.Topic == "" && conf.RunConfig.DeliversRules[i].Topic != "" {
+		log.Warn("topic template of deliver rule is empty for message", zap.String("topic", conf.RunConfig.DeliversRules[i].Topic), zap.String("ClientID", e.ClientID), zap.String("mqtt topic", e.Topic))
+		return nil
+	}
+	//only a QoS 1/2 publish is acked on the confirmed write
+	if dm.Confirm && e.Qos == 0 {
+		rule := *dm
+		rule.Confirm = false
+		dm = &rule
+	}
 
-func matchTopicSplit(subTopic *[]string, topic string) bool {
-	return match(*subTopic, strings.Split(topic, "/"))
+	t, ok := d.targets[dm.Plugin][dm.Target]
+	if !ok {
+		log.Warn("plugin not defined", zap.String("plugin name", dm.Plugin))
+		return nil
+	}
+	//only the failure of a confirmed write holds the ack back
+	if err := t.Publish(dm, key, msg); err != nil {
+		if dm.Confirm {
+			return err
+		}
+		log.Error("send message to target error", zap.String("plugin", dm.Plugin), zap.String("target", dm.Target), zap.Error(err))
+	}
+	return nil
 }
@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"rocketmqtt/conf"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// formats of the messages sent to a target, the format of a deliver rule
+const (
+	// FormatRaw is the payload alone
+	FormatRaw = "raw"
+	// FormatJSON is the message with all its fields, see Elements
+	FormatJSON = "json"
+	// FormatProtobuf is the Envelope message, see encodeProtobuf
+	FormatProtobuf = "protobuf"
+)
+
+// encodings of the payload in a JSON envelope
+const (
+	PayloadBase64 = "base64"
+	PayloadString = "string"
+)
+
+// ruleName names rule in errors, by its sql or its pattern
+func ruleName(rule *conf.DeliversRule) string {
+	if rule.Sql != "" {
+		return rule.Sql
+	}
+	return rule.Pattern
+}
+
+// checkFormat makes sure the format of rule is known
+func checkFormat(rule *conf.DeliversRule) error {
+	switch rule.Format {
+	case "", FormatRaw, FormatProtobuf:
+	case FormatJSON:
+		switch rule.PayloadEncoding {
+		case "", PayloadBase64, PayloadString:
+		default:
+			return fmt.Errorf("deliver rule %s: unknown payload encoding %s", ruleName(rule), rule.PayloadEncoding)
+		}
+	default:
+		return fmt.Errorf("deliver rule %s: unknown format %s", ruleName(rule), rule.Format)
+	}
+	return nil
+}
+
+// encode returns the body of msg in the format of rule
+func encode(rule *conf.DeliversRule, msg *Elements) ([]byte, error) {
+	switch rule.Format {
+	case FormatJSON:
+		if rule.PayloadEncoding == PayloadString {
+			return json.Marshal(struct {
+				*Elements
+				Payload string `json:"payload"`
+			}{msg, string(msg.Payload)})
+		}
+		return json.Marshal(msg)
+	case FormatProtobuf:
+		return encodeProtobuf(msg), nil
+	}
+	return msg.Payload, nil
+}
+
+// encodeProtobuf writes msg as this proto3 message, fields with their zero
+// value are left out as proto3 does:
+//
+//	message Envelope {
+//	  string client_id = 1;
+//	  string username = 2;
+//	  string topic = 3;      // mqtt topic
+//	  bytes payload = 4;
+//	  int64 timestamp = 5;   // unix nanoseconds
+//	  int32 size = 6;
+//	  string action = 7;     // publish, or the action of a lifecycle event
+//	  string ip = 8;
+//	  uint32 keepalive = 9;
+//	  uint32 qos = 10;
+//	  string reason = 11;
+//	}
+func encodeProtobuf(msg *Elements) []byte {
+	b := proto.NewBuffer(make([]byte, 0, len(msg.Payload)+64))
+	str := func(field uint64, s string) {
+		if s != "" {
+			b.EncodeVarint(field<<3 | proto.WireBytes)
+			b.EncodeStringBytes(s)
+		}
+	}
+	varint := func(field uint64, v uint64) {
+		if v != 0 {
+			b.EncodeVarint(field<<3 | proto.WireVarint)
+			b.EncodeVarint(v)
+		}
+	}
+
+	str(1, msg.ClientID)
+	str(2, msg.Username)
+	str(3, msg.Topic)
+	if len(msg.Payload) > 0 {
+		b.EncodeVarint(4<<3 | proto.WireBytes)
+		b.EncodeRawBytes(msg.Payload)
+	}
+	varint(5, uint64(msg.Timestamp))
+	varint(6, uint64(msg.Size))
+	str(7, msg.Action)
+	str(8, msg.IP)
+	varint(9, uint64(msg.Keepalive))
+	varint(10, uint64(msg.Qos))
+	str(11, msg.Reason)
+	return b.Bytes()
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"rocketmqtt/conf"
+)
+
+// reasons of a disconnect event
+const (
+	ReasonNormal           = "normal"
+	ReasonKeepaliveTimeout = "keepalive_timeout"
+	ReasonTakenOver        = "taken_over"
+	ReasonKicked           = "kicked"
+	ReasonProtocolError    = "protocol_error"
+	ReasonConnectionLost   = "connection_lost"
+)
+
+// Event is the JSON envelope of a lifecycle event of a client, the payload
+// of the message sent to the event topic
+type Event struct {
+	Action    string `json:"action"`
+	ClientID  string `json:"clientId"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	Keepalive uint16 `json:"keepalive"`
+	// unix nanoseconds
+	Timestamp int64 `json:"timestamp"`
+	// why a client disconnected
+	Reason string `json:"reason,omitempty"`
+	// topic and requested qos of a subscribe, topic of an unsubscribe
+	Topic string `json:"topic,omitempty"`
+	Qos   *byte  `json:"qos,omitempty"`
+	// id of the broker the client is on
+	Node string `json:"node"`
+}
+
+func eventTopic(e *Elements) string {
+	events := &conf.RunConfig.Events
+	switch e.Action {
+	case Connect:
+		return events.Connect
+	case Disconnect:
+		return events.Disconnect
+	case Subscribe:
+		return events.Subscribe
+	case Unsubscribe:
+		return events.Unsubscribe
+	}
+	return ""
+}
+
+// checkEvents makes sure the target of the events exists
+func (d *deliver) checkEvents(events *conf.Events) error {
+	if events.Plugin == "" {
+		return nil
+	}
+	if _, ok := d.targets[events.Plugin][events.Target]; !ok {
+		return fmt.Errorf("events: %s target %s not found or disabled", events.Plugin, events.Target)
+	}
+	return nil
+}
+
+// publishEvent sends lifecycle event e to its topic, if it has one
+func (d *deliver) publishEvent(e *Elements) error {
+	events := &conf.RunConfig.Events
+	topic := eventTopic(e)
+	if events.Plugin == "" || topic == "" {
+		return nil
+	}
+	t, ok := d.targets[events.Plugin][events.Target]
+	if !ok {
+		return nil
+	}
+
+	ev := Event{
+		Action:    e.Action,
+		ClientID:  e.ClientID,
+		Username:  e.Username,
+		IP:        e.IP,
+		Keepalive: e.Keepalive,
+		Timestamp: e.Timestamp,
+		Reason:    e.Reason,
+		Topic:     e.Topic,
+		Node:      conf.RunConfig.Broker.ID,
+	}
+	if e.Action == Subscribe {
+		qos := e.Qos
+		ev.Qos = &qos
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	rule := &conf.DeliversRule{
+		Plugin: events.Plugin,
+		Target: events.Target,
+		Topic:  topic,
+		Tag:    events.Tag,
+	}
+	return t.Publish(rule, e.ClientID, &Elements{
+		ClientID:  e.ClientID,
+		Username:  e.Username,
+		Topic:     e.Topic,
+		Payload:   payload,
+		Timestamp: e.Timestamp,
+		Action:    e.Action,
+	})
+}
@@ -2,7 +2,9 @@ package bridge
 
 import (
 	"errors"
+	"fmt"
 	"rocketmqtt/conf"
+	"strconv"
 	"time"
 
 	"sync"
@@ -13,22 +15,43 @@ import (
 
 // var KafkaClients map[string]*kafka
 
+var errWriteTimeout = errors.New("write kafka timeout")
+
 type kafka struct {
-	kafakConfig conf.Kafka
-	kafkaClient sarama.AsyncProducer
-	timerPool   sync.Pool
-	Headers     []sarama.RecordHeader
+	kafakConfig   conf.Kafka
+	kafkaClient   sarama.AsyncProducer
+	kafkaConsumer sarama.ConsumerGroup
+	timerPool     sync.Pool
+	Headers       []sarama.RecordHeader
+	lastErr       lastError
+	// failed gets the messages nobody waits for that kafka failed to
+	// take, nil without a spool
+	failed func(rule *conf.DeliversRule, key string, msg *Elements)
+}
+
+// asyncMsg is the metadata of a message nobody waits for, what the spool
+// needs to keep it when the write fails
+type asyncMsg struct {
+	rule conf.DeliversRule
+	key  string
+	msg  Elements
+}
+
+func init() {
+	Register(Kafka, InitKafka)
 }
 
-func InitKafka() map[string]*kafka {
-	var kafkas = make(map[string]*kafka)
+func InitKafka() (map[string]Target, error) {
+	var kafkas = make(map[string]Target)
 	for _, r := range conf.RunConfig.Plugins.Kafka {
 		if !r.Enable {
 			continue
 		}
 		c := &kafka{kafakConfig: r}
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
 		kafkas[r.Name] = c
-		c.connect()
 		if conf.RunConfig.Broker.ID != "" {
 			c.Headers = append(c.Headers, sarama.RecordHeader{
 				Key:   []byte("bid"),
@@ -36,23 +59,141 @@ func InitKafka() map[string]*kafka {
 			})
 		}
 	}
-	return kafkas
+	return kafkas, nil
+}
+
+func (k *kafka) GetConsumer() sarama.ConsumerGroup {
+	return k.kafkaConsumer
+}
+func (k *kafka) GetConfig() conf.Kafka {
+	return k.kafakConfig
+}
+
+// config builds the client config of the target, for the producer and the
+// consumer
+func (k *kafka) config() (*sarama.Config, error) {
+	cfg := &k.kafakConfig
+	sc := sarama.NewConfig()
+	sc.Version = sarama.V2_2_0_0
+	if cfg.Version != "" {
+		v, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		sc.Version = v
+	}
+
+	// confirmed writes wait for their success
+	sc.Producer.Return.Successes = true
+	switch cfg.RequiredAcks {
+	case "", "leader":
+		sc.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		sc.Producer.RequiredAcks = sarama.NoResponse
+	case "all":
+		sc.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("unknown requiredAcks %q", cfg.RequiredAcks)
+	}
+	switch cfg.Compression {
+	case "", "none":
+		sc.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		sc.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		sc.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		sc.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		sc.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+	switch cfg.Partitioner {
+	case "", "hash":
+		sc.Producer.Partitioner = sarama.NewHashPartitioner
+	case "random":
+		sc.Producer.Partitioner = sarama.NewRandomPartitioner
+	case "roundrobin":
+		sc.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	default:
+		return nil, fmt.Errorf("unknown partitioner %q", cfg.Partitioner)
+	}
+	if cfg.Idempotent {
+		sc.Producer.Idempotent = true
+		// sarama keeps the order of an idempotent producer with one request
+		// in flight per broker
+		sc.Net.MaxOpenRequests = 1
+	}
+	sc.Producer.Flush.Messages = cfg.FlushMessages
+	sc.Producer.Flush.Bytes = cfg.FlushBytes
+	sc.Producer.Flush.Frequency = time.Duration(cfg.FlushFrequency) * time.Millisecond
+
+	if cfg.TLS.Enable {
+		tlsConfig, err := cfg.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		sc.Net.TLS.Enable = true
+		sc.Net.TLS.Config = tlsConfig
+	}
+	if cfg.SASL.Enable {
+		sc.Net.SASL.Enable = true
+		sc.Net.SASL.User = cfg.SASL.User
+		sc.Net.SASL.Password = cfg.SASL.Password
+		switch cfg.SASL.Mechanism {
+		case "", sarama.SASLTypePlaintext:
+			sc.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256:
+			sc.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			sc.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: sha256Hash}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			sc.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			sc.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: sha512Hash}
+			}
+		default:
+			return nil, fmt.Errorf("unknown sasl mechanism %q", cfg.SASL.Mechanism)
+		}
+	}
+
+	// Validate catches the settings that don't go together, an idempotent
+	// producer without acks from all replicas for one
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	return sc, nil
 }
 
-//connect
-func (k *kafka) connect() {
-	conf := sarama.NewConfig()
-	conf.Version = sarama.V2_2_0_0
-	kafkaClient, err := sarama.NewAsyncProducer(k.kafakConfig.Addr, conf)
+// connect
+func (k *kafka) connect() error {
+	sc, err := k.config()
+	if err != nil {
+		return fmt.Errorf("kafka %s config error: %v", k.kafakConfig.Name, err)
+	}
+	kafkaClient, err := sarama.NewAsyncProducer(k.kafakConfig.Addr, sc)
 	if err != nil {
-		log.Fatal("create kafka async producer failed: ", zap.Error(err))
+		return fmt.Errorf("create kafka async producer %s failed: %v", k.kafakConfig.Name, err)
 	}
 
-	go func() {
-		for err := range kafkaClient.Errors() {
-			log.Error("send msg to kafka failed: ", zap.Error(err))
+	if k.kafakConfig.EnableSubscribe {
+		sc.Consumer.Return.Errors = true
+		consumer, err := sarama.NewConsumerGroup(k.kafakConfig.Addr, k.kafakConfig.GroupName, sc)
+		if err != nil {
+			kafkaClient.Close()
+			return fmt.Errorf("create kafka consumer group %s failed: %v", k.kafakConfig.Name, err)
 		}
-	}()
+		go func() {
+			for err := range consumer.Errors() {
+				log.Error("consume kafka msg failed: ", zap.Error(err))
+			}
+		}()
+		k.kafkaConsumer = consumer
+	}
+
+	k.watch(kafkaClient)
 
 	k.timerPool = sync.Pool{
 		New: func() interface{} {
@@ -60,37 +201,136 @@ func (k *kafka) connect() {
 		},
 	}
 	k.kafkaClient = kafkaClient
+	return nil
 }
 
-func (k *kafka) publish(topic string, key string, msg *Elements) error {
+// watch hands the results of the producer to the writes waiting for them,
+// and the failed messages nobody waits for to the spool
+func (k *kafka) watch(producer sarama.AsyncProducer) {
+	go func() {
+		for err := range producer.Errors() {
+			log.Error("send msg to kafka failed: ", zap.Error(err))
+			k.lastErr.set(err)
+			switch md := err.Msg.Metadata.(type) {
+			case chan error:
+				md <- err.Err
+			case *asyncMsg:
+				k.failed(&md.rule, md.key, &md.msg)
+			}
+		}
+	}()
+	go func() {
+		for msg := range producer.Successes() {
+			if done, ok := msg.Metadata.(chan error); ok {
+				done <- nil
+			}
+		}
+	}()
+}
+
+func (k *kafka) Publish(rule *conf.DeliversRule, key string, msg *Elements) error {
+	payload, err := encode(rule, msg)
+	if err != nil {
+		return err
+	}
+	var async *asyncMsg
+	if !rule.Confirm && k.failed != nil {
+		// a copy, msg goes back to its pool once Publish returns
+		async = &asyncMsg{rule: *rule, key: key, msg: *msg}
+	}
+	return k.publish(rule.Topic, key, payload, msg, rule.Confirm, async)
+}
+
+// onFailed hands the messages kafka fails to take after Publish returned
+// to f
+func (k *kafka) onFailed(f func(rule *conf.DeliversRule, key string, msg *Elements)) {
+	k.failed = f
+}
+
+// Flush is a no-op, the async producer sends messages as they come
+func (k *kafka) Flush() error {
+	return nil
+}
+
+// Close sends the messages the producer holds and stops the consumer
+func (k *kafka) Close() error {
+	if k.kafkaConsumer != nil {
+		if err := k.kafkaConsumer.Close(); err != nil {
+			log.Error("close kafka consumer failed: ", zap.Error(err))
+		}
+	}
+	return k.kafkaClient.Close()
+}
+
+func (k *kafka) spoolConfig() conf.Spool {
+	return k.kafakConfig.Spool
+}
+
+func (k *kafka) Health() error {
+	return k.lastErr.get()
+}
+
+// headers are the ones of the target and the fields of msg a consumer
+// routes on
+func (k *kafka) headers(msg *Elements) []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, len(k.Headers), len(k.Headers)+5)
+	copy(headers, k.Headers)
+	return append(headers,
+		sarama.RecordHeader{Key: []byte("clientId"), Value: []byte(msg.ClientID)},
+		sarama.RecordHeader{Key: []byte("topic"), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte("username"), Value: []byte(msg.Username)},
+		sarama.RecordHeader{Key: []byte("qos"), Value: []byte(strconv.Itoa(int(msg.Qos)))},
+		sarama.RecordHeader{Key: []byte("timestamp"), Value: []byte(strconv.FormatInt(msg.Timestamp, 10))},
+	)
+}
+
+// publish queues the message to the producer, with confirm it waits for
+// kafka to have it as well. Without, async comes back to failed if the
+// write fails.
+func (k *kafka) publish(topic string, key string, payload []byte, msg *Elements, confirm bool, async *asyncMsg) error {
 	//for _, topic := range topics {
 	t := k.timerPool.Get().(*time.Timer)
 
 	if !t.Stop() {
-		<-t.C
+		select {
+		case <-t.C:
+		default:
+		}
 	}
 	t.Reset(time.Duration(5) * time.Second)
-	//Headers := append(k.Headers, sarama.RecordHeader{
-	//	Key: []byte("topic"),
-	//	Value: []byte(msg.Topic),
-	//})
-	//Headers = append(Headers, sarama.RecordHeader{
-	//	Key: []byte("clientId"),
-	//	Value: []byte(msg.ClientID),
-	//})
-	select {
-	case k.kafkaClient.Input() <- &sarama.ProducerMessage{
-		Headers: k.Headers,
+	defer k.timerPool.Put(t)
+
+	pm := &sarama.ProducerMessage{
+		Headers: k.headers(msg),
 		Topic:   topic,
 		Key:     sarama.StringEncoder(key),
-		Value:   sarama.ByteEncoder(msg.Payload),
-	}:
-		k.timerPool.Put(t)
+		Value:   sarama.ByteEncoder(payload),
+	}
+	var done chan error
+	if confirm {
+		done = make(chan error, 1)
+		pm.Metadata = done
+	} else if async != nil {
+		pm.Metadata = async
+	}
+
+	select {
+	case k.kafkaClient.Input() <- pm:
 		//continue
 	case <-t.C:
-		k.timerPool.Put(t)
-		return errors.New("write kafka timeout")
+		k.lastErr.set(errWriteTimeout)
+		return errWriteTimeout
 	}
 	//}
-	return nil
+	if !confirm {
+		return nil
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		k.lastErr.set(errWriteTimeout)
+		return errWriteTimeout
+	}
 }
@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"container/list"
+	"fmt"
+	"rocketmqtt/broker/lib/topics"
+	"rocketmqtt/conf"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// matchCacheSize is how many topics the matcher keeps the rules of
+const matchCacheSize = 10000
+
+// ruleMatcher finds the deliver rules of a topic in a topic tree of their
+// patterns, the same as the subscriptions of the broker. The rules of the
+// last topics are kept in an LRU cache.
+type ruleMatcher struct {
+	tree  topics.TopicsProvider
+	cache *lru
+}
+
+func newRuleMatcher(rules []conf.DeliversRule, compiled []*compiledRule) (*ruleMatcher, error) {
+	m := &ruleMatcher{
+		tree:  topics.NewMemProvider(),
+		cache: newLRU(matchCacheSize),
+	}
+	for i := range rules {
+		filters := []string{rules[i].Pattern}
+		if compiled[i].stmt != nil {
+			filters = compiled[i].stmt.Filters()
+		}
+		for _, f := range filters {
+			// the subscriber is the index of the rule
+			if _, err := m.tree.Subscribe([]byte(f), 0, i); err != nil {
+				return nil, fmt.Errorf("deliver rule %d: filter %s: %v", i, f, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// match returns the indexes of the rules of topic, in the order of the
+// config
+func (m *ruleMatcher) match(topic string) []int {
+	if rules, ok := m.cache.get(topic); ok {
+		return rules
+	}
+
+	var subs []interface{}
+	var qoss []byte
+	if err := m.tree.Subscribers([]byte(topic), 0, &subs, &qoss); err != nil {
+		log.Warn("match deliver rules error", zap.String("topic", topic), zap.Error(err))
+		return nil
+	}
+	rules := make([]int, 0, len(subs))
+	for _, s := range subs {
+		rules = append(rules, s.(int))
+	}
+	sort.Ints(rules)
+	// a rule matching by two of its filters is sent once
+	n := 0
+	for i, r := range rules {
+		if i == 0 || r != rules[n-1] {
+			rules[n] = r
+			n++
+		}
+	}
+	rules = rules[:n]
+
+	m.cache.add(topic, rules)
+	return rules
+}
+
+// lru maps the last used topics to their rules
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	topic string
+	rules []int
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lru) get(topic string) ([]int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[topic]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).rules, true
+}
+
+// add stores the rules of topic, the least recently used topic goes once
+// the cache is full
+func (c *lru) add(topic string, rules []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[topic]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).rules = rules
+		return
+	}
+	c.items[topic] = c.ll.PushFront(&lruEntry{topic: topic, rules: rules})
+	if c.ll.Len() > c.size {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*lruEntry).topic)
+	}
+}
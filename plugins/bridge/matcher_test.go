@@ -0,0 +1,186 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"rocketmqtt/conf"
+)
+
+var matcherRules = []conf.DeliversRule{
+	{Pattern: "#"},
+	{Pattern: "+/up/#"},
+	// matches dev/up/temp by both its filters
+	{Sql: `SELECT * FROM "+/up/#", "dev/+/temp"`},
+	{Pattern: "dev/+/temp"},
+	{Pattern: "$SYS/#"},
+	{Pattern: "a/b"},
+	{Sql: `SELECT clientid FROM "a/+" WHERE qos > 0`},
+}
+
+func newTestMatcher(t *testing.T, rules []conf.DeliversRule) *ruleMatcher {
+	t.Helper()
+	compiled := make([]*compiledRule, len(rules))
+	for i := range rules {
+		cr, err := compileRule(&rules[i])
+		if err != nil {
+			t.Fatalf("rule %d: %v", i, err)
+		}
+		compiled[i] = cr
+	}
+	m, err := newRuleMatcher(rules, compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRuleMatcher(t *testing.T) {
+	m := newTestMatcher(t, matcherRules)
+
+	tests := []struct {
+		topic string
+		want  []int
+	}{
+		{"a/b", []int{0, 5, 6}},
+		{"a/c", []int{0, 6}},
+		{"a/b/c", []int{0}},
+		{"dev/up/temp", []int{0, 1, 2, 3}},
+		{"dev/down/temp", []int{0, 2, 3}},
+		{"x/up", []int{0, 1, 2}},
+		{"x/up/a/b", []int{0, 1, 2}},
+		{"up/x", []int{0}},
+		// the tree of the broker subscriptions, # takes $ topics as well
+		{"$SYS/broker/clients", []int{0, 4}},
+		{"other", []int{0}},
+	}
+	// twice, the second time from the cache
+	for _, pass := range []string{"cold", "cached"} {
+		for _, tt := range tests {
+			if got := m.match(tt.topic); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s match(%q) = %v, want %v", pass, tt.topic, got, tt.want)
+			}
+		}
+	}
+}
+
+// TestRuleMatcherManyRules checks the rules past the first 64 match, from
+// the tree and from the cache.
+func TestRuleMatcherManyRules(t *testing.T) {
+	rules := make([]conf.DeliversRule, 100)
+	for i := range rules {
+		rules[i].Pattern = fmt.Sprintf("r%d/#", i)
+	}
+	rules[70].Pattern = "wide/#"
+	rules[85].Sql = `SELECT * FROM "+/deep/#"`
+	rules[85].Pattern = ""
+	rules[99].Pattern = "#"
+	m := newTestMatcher(t, rules)
+
+	tests := []struct {
+		topic string
+		want  []int
+	}{
+		{"r80/a", []int{80, 99}},
+		{"r3/deep/z", []int{3, 85, 99}},
+		{"wide/deep/x", []int{70, 85, 99}},
+		{"r70/x", []int{99}},
+		{"r98", []int{98, 99}},
+	}
+	for _, pass := range []string{"cold", "cached"} {
+		for _, tt := range tests {
+			if got := m.match(tt.topic); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s match(%q) = %v, want %v", pass, tt.topic, got, tt.want)
+			}
+		}
+	}
+	if n := m.cache.ll.Len(); n != len(tests) {
+		t.Fatalf("cache holds %d topics, want %d", n, len(tests))
+	}
+}
+
+func TestRuleMatcherLRU(t *testing.T) {
+	m := newTestMatcher(t, matcherRules)
+	m.cache = newLRU(3)
+
+	topics := []string{"a/b", "dev/up/temp", "x/up", "a/c", "other", "$SYS/x", "dev/down/temp"}
+	// hits and evictions in every order give what a cold matcher does
+	for i := 0; i < 200; i++ {
+		topic := topics[(i*7+i/3)%len(topics)]
+		cold := newTestMatcher(t, matcherRules)
+		if got, want := m.match(topic), cold.match(topic); !reflect.DeepEqual(got, want) {
+			t.Fatalf("match(%q) = %v, cold match %v", topic, got, want)
+		}
+		if n := m.cache.ll.Len(); n > 3 || len(m.cache.items) != n {
+			t.Fatalf("cache holds %d entries, %d indexed", n, len(m.cache.items))
+		}
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", []int{1})
+	c.add("b", []int{2})
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a not cached")
+	}
+	c.add("c", []int{3})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("b, the least recently used, still cached")
+	}
+	for topic, want := range map[string][]int{"a": {1}, "c": {3}} {
+		if got, ok := c.get(topic); !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("get(%q) = %v, %v, want %v", topic, got, ok, want)
+		}
+	}
+
+	// adding a topic again replaces its rules
+	c.add("a", []int{4})
+	if got, _ := c.get("a"); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("get(a) = %v after an update", got)
+	}
+}
+
+func TestRuleMatcherRebuiltWithRules(t *testing.T) {
+	d := &deliver{targets: map[string]map[string]Target{Kafka: {"up": nil}}}
+	rule := func(pattern string) conf.DeliversRule {
+		return conf.DeliversRule{Pattern: pattern, Plugin: Kafka, Target: "up"}
+	}
+
+	if err := d.check([]conf.DeliversRule{rule("a/#")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.matcher.match("a/b"); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("match(a/b) = %v", got)
+	}
+
+	// the topic cached with the old rules is matched against the new ones
+	if err := d.check([]conf.DeliversRule{rule("b/#"), rule("+/b")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.matcher.match("a/b"); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("match(a/b) = %v after the rules changed", got)
+	}
+	if got := d.matcher.match("b/c"); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("match(b/c) = %v after the rules changed", got)
+	}
+}
+
+func BenchmarkRuleMatcher(b *testing.B) {
+	rules := make([]conf.DeliversRule, 100)
+	compiled := make([]*compiledRule, len(rules))
+	for i := range rules {
+		rules[i].Pattern = fmt.Sprintf("tenant%d/+/up/#", i)
+		compiled[i], _ = compileRule(&rules[i])
+	}
+	m, err := newRuleMatcher(rules, compiled)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.match(fmt.Sprintf("tenant%d/dev/up/temp", i%100))
+	}
+}
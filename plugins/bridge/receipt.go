@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"rocketmqtt/conf"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/apache/rocketmq-client-go/v2/primitive"
+	"go.uber.org/zap"
+)
+
+// statuses of a receipt
+const (
+	ReceiptAcked   = "acked"
+	ReceiptQueued  = "queued"
+	ReceiptFailed  = "failed"
+	ReceiptTimeout = "timeout"
+)
+
+// Receipt is the JSON payload of the message sent to the receipt topic, it
+// tells what became of a subscribed message sent to a client
+type Receipt struct {
+	// id of the subscribed message, topic/partition/offset of a kafka one
+	MsgID    string `json:"msgId"`
+	ClientID string `json:"clientId"`
+	Topic    string `json:"topic"`
+	// acked by the client, on this node or the one it is connected to,
+	// failed, or timeout without an ack. queued comes before acked when the
+	// client is offline and the message waits in its session, it doesn't
+	// time out then.
+	Status string `json:"status"`
+	// why a message failed
+	Reason string `json:"reason,omitempty"`
+	// unix nanoseconds
+	Timestamp int64 `json:"timestamp"`
+	// id of the broker that sent the message
+	Node string `json:"node"`
+}
+
+// Receipt sends the receipt of msg to the receipt topic in the background,
+// so an ack of the client waits for nothing
+func (r *rocketMQ) Receipt(msg *primitive.MessageExt, status, reason string) {
+	rc := Receipt{
+		MsgID:     msg.MsgId,
+		ClientID:  msg.GetProperty("clientId"),
+		Topic:     msg.GetProperty("topic"),
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano(),
+		Node:      conf.RunConfig.Broker.ID,
+	}
+	payload, err := json.Marshal(rc)
+	if err != nil {
+		log.Error("marshal receipt error", zap.Error(err))
+		return
+	}
+
+	rmsg := primitive.NewMessage(r.rocketMQConfig.ReceiptTopic, payload)
+	rmsg.WithKeys([]string{rc.MsgID})
+	rmsg.WithProperty("clientId", rc.ClientID)
+	rmsg.WithProperty("status", status)
+	err = r.rocketMQProducer.SendAsync(context.Background(),
+		func(ctx context.Context, res *primitive.SendResult, err error) {
+			if err != nil {
+				log.Warn("send receipt error", zap.Error(err), zap.String("msgId", rc.MsgID))
+				r.lastErr.set(err)
+			}
+		}, rmsg)
+	if err != nil {
+		log.Warn("send receipt error", zap.Error(err), zap.String("msgId", rc.MsgID))
+		r.lastErr.set(err)
+	}
+}
+
+// Receipt sends the receipt of the consumed msg to the receipt topic. It
+// waits for no room in the producer, a receipt kafka can't take right away
+// is dropped.
+func (k *kafka) Receipt(msg *sarama.ConsumerMessage, clientID, topic, status, reason string) {
+	rc := Receipt{
+		MsgID:     fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset),
+		ClientID:  clientID,
+		Topic:     topic,
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano(),
+		Node:      conf.RunConfig.Broker.ID,
+	}
+	payload, err := json.Marshal(rc)
+	if err != nil {
+		log.Error("marshal receipt error", zap.Error(err))
+		return
+	}
+
+	pm := &sarama.ProducerMessage{
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("clientId"), Value: []byte(clientID)},
+			{Key: []byte("status"), Value: []byte(status)},
+		},
+		Topic: k.kafakConfig.ReceiptTopic,
+		Key:   sarama.StringEncoder(clientID),
+		Value: sarama.ByteEncoder(payload),
+	}
+	select {
+	case k.kafkaClient.Input() <- pm:
+	default:
+		log.Warn("send receipt error", zap.Error(errWriteTimeout), zap.String("msgId", rc.MsgID))
+		k.lastErr.set(errWriteTimeout)
+	}
+}
@@ -2,10 +2,14 @@ package bridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"hash/fnv"
 	"rocketmqtt/conf"
 	"rocketmqtt/logger"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apache/rocketmq-client-go/v2"
 	"github.com/apache/rocketmq-client-go/v2/consumer"
@@ -15,27 +19,67 @@ import (
 	"go.uber.org/zap"
 )
 
+var errInFlightFull = errors.New("too many rocketmq messages in flight")
+
+// policies of a subscribed message the client can't get
+const (
+	UndeliveredDrop       = "drop"
+	UndeliveredRetry      = "retry"
+	UndeliveredDeadLetter = "deadletter"
+	UndeliveredPark       = "park"
+)
+
 type rocketMQ struct {
 	rocketMQConfig       conf.Rocketmq
 	rocketMQPushConsumer rocketmq.PushConsumer
 	rocketMQProducer     rocketmq.Producer
+	lastErr              lastError
+
+	// inFlight holds a token per async message queued or being sent
+	inFlight chan struct{}
+	// batches takes the async messages to batch, lanes the orderly ones, a
+	// lane per worker
+	batches chan *rmqMsg
+	lanes   []chan *rmqMsg
+	flush   chan chan struct{}
+	senders sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+	// errors counts the async messages that failed
+	errors uint64
+	// failed gets the async messages rocketmq failed to take, nil without
+	// a spool
+	failed func(rule *conf.DeliversRule, key string, msg *Elements)
+}
+
+// rmqMsg is an async message, with what the spool needs to keep it when
+// the send fails
+type rmqMsg struct {
+	*primitive.Message
+	async *asyncMsg
+}
+
+func init() {
+	Register(Rocketmq, InitRocketMQPushConsumer)
 }
 
 //Init RocketMQ Push client
-func InitRocketMQPushConsumer() map[string]*rocketMQ {
+func InitRocketMQPushConsumer() (map[string]Target, error) {
 	rmqLogger := logger.RmqLogger{}
 	rmqLogger.Init(logger.Instance.Sugar().Named("rocketmq"))
 	rlog.SetLogger(&rmqLogger)
-	var rmqs = make(map[string]*rocketMQ)
+	var rmqs = make(map[string]Target)
 	for _, r := range conf.RunConfig.Plugins.Rocketmq {
 		if !r.Enable {
 			continue
 		}
 		c := &rocketMQ{rocketMQConfig: r}
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
 		rmqs[r.Name] = c
-		c.connect()
 	}
-	return rmqs
+	return rmqs, nil
 }
 
 func (r *rocketMQ) GetProducer() rocketmq.PushConsumer {
@@ -45,13 +89,24 @@ func (r *rocketMQ) GetConfig() conf.Rocketmq {
 	return r.rocketMQConfig
 }
 
-func (r *rocketMQ) connect() {
+func (r *rocketMQ) connect() error {
 	ns, err := primitive.NewNamesrvAddr(r.rocketMQConfig.NameSrv)
 	if err != nil {
-		log.Fatal("name server error: ", zap.Error(err))
+		return fmt.Errorf("rocketmq %s name server error: %v", r.rocketMQConfig.Name, err)
 	}
 	var c rocketmq.PushConsumer
 	if r.rocketMQConfig.EnableSubscribe {
+		switch r.rocketMQConfig.Undelivered {
+		case "":
+			r.rocketMQConfig.Undelivered = UndeliveredDrop
+		case UndeliveredDrop, UndeliveredRetry, UndeliveredPark:
+		case UndeliveredDeadLetter:
+			if r.rocketMQConfig.DeadLetterTopic == "" {
+				return fmt.Errorf("rocketmq %s deadletter needs a deadLetterTopic", r.rocketMQConfig.Name)
+			}
+		default:
+			return fmt.Errorf("rocketmq %s unknown undelivered policy %q", r.rocketMQConfig.Name, r.rocketMQConfig.Undelivered)
+		}
 		msgModel := consumer.Clustering
 		if r.rocketMQConfig.SubscribeModel == "BroadCasting" {
 			msgModel = consumer.BroadCasting
@@ -63,37 +118,152 @@ func (r *rocketMQ) connect() {
 			consumer.WithInstance(fmt.Sprintf("%s-%s", conf.RunConfig.Broker.ID, r.rocketMQConfig.GroupName)),
 		)
 		if err != nil {
-			log.Fatal("new push consumer error: ", zap.Error(err))
+			return fmt.Errorf("rocketmq %s new push consumer error: %v", r.rocketMQConfig.Name, err)
 		}
 	}
-	p, _ := rocketmq.NewProducer(
+	opts := []producer.Option{
 		producer.WithNameServer(ns),
 		producer.WithRetry(2),
 		producer.WithGroupName(r.rocketMQConfig.GroupName),
 		//producer.WithInstanceName(r.rocketMQConfig.GroupName),
-	)
+	}
+	if r.rocketMQConfig.Orderly {
+		// the messages carry the client id as sharding key
+		opts = append(opts, producer.WithQueueSelector(producer.NewHashQueueSelector()))
+	}
+	p, err := rocketmq.NewProducer(opts...)
+	if err != nil {
+		return fmt.Errorf("rocketmq %s new producer error: %v", r.rocketMQConfig.Name, err)
+	}
 	err = p.Start()
 	if err != nil {
-		log.Fatal("start producer error: %s", zap.Error(err))
-		os.Exit(1)
+		return fmt.Errorf("rocketmq %s start producer error: %v", r.rocketMQConfig.Name, err)
 	}
 
 	r.rocketMQPushConsumer = c
 	r.rocketMQProducer = p
+	if r.rocketMQConfig.Async {
+		r.startSenders()
+	}
+	return nil
+}
+
+func (r *rocketMQ) startSenders() {
+	cfg := &r.rocketMQConfig
+	size := cfg.MaxInFlight
+	if size <= 0 {
+		size = 10000
+	}
+	r.inFlight = make(chan struct{}, size)
+
+	if !cfg.Orderly {
+		r.batches = make(chan *rmqMsg, size)
+		r.flush = make(chan chan struct{})
+		r.senders.Add(1)
+		go r.batch()
+		return
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 8
+	}
+	r.lanes = make([]chan *rmqMsg, workers)
+	for i := range r.lanes {
+		r.lanes[i] = make(chan *rmqMsg, size)
+		r.senders.Add(1)
+		go r.lane(r.lanes[i])
+	}
+}
+
+func (r *rocketMQ) Publish(rule *conf.DeliversRule, key string, msg *Elements) error {
+	payload, err := encode(rule, msg)
+	if err != nil {
+		return err
+	}
+	rmsg := r.message(rule.Topic, key, payload, msg, rule.Tag)
+	if r.rocketMQConfig.Async && !rule.Confirm {
+		m := &rmqMsg{Message: rmsg}
+		if r.failed != nil {
+			// a copy, msg goes back to its pool once Publish returns
+			m.async = &asyncMsg{rule: *rule, key: key, msg: *msg}
+		}
+		return r.publishAsync(m, msg.ClientID)
+	}
+	return r.publish(rmsg)
+}
+
+// onFailed hands the async messages rocketmq fails to take after Publish
+// returned to f
+func (r *rocketMQ) onFailed(f func(rule *conf.DeliversRule, key string, msg *Elements)) {
+	r.failed = f
+}
+
+// Flush sends the pending batches and waits for the async messages to be
+// sent
+func (r *rocketMQ) Flush() error {
+	if !r.rocketMQConfig.Async {
+		return nil
+	}
+	r.mu.RLock()
+	if !r.closed && r.flush != nil {
+		done := make(chan struct{})
+		r.flush <- done
+		<-done
+	}
+	r.mu.RUnlock()
+
+	for len(r.inFlight) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (r *rocketMQ) Close() error {
+	if r.rocketMQPushConsumer != nil {
+		if err := r.rocketMQPushConsumer.Shutdown(); err != nil {
+			log.Error("shutdown rocketmq consumer error: ", zap.Error(err))
+		}
+	}
+	if r.rocketMQConfig.Async {
+		r.mu.Lock()
+		r.closed = true
+		if r.batches != nil {
+			close(r.batches)
+		}
+		for _, l := range r.lanes {
+			close(l)
+		}
+		r.mu.Unlock()
+
+		r.senders.Wait()
+		// the batches sent last may wait for their answer
+		deadline := time.Now().Add(5 * time.Second)
+		for len(r.inFlight) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return r.rocketMQProducer.Shutdown()
 }
 
-func (r *rocketMQ) publish(topic string, key string, msg *Elements, tag string) error {
+func (r *rocketMQ) spoolConfig() conf.Spool {
+	return r.rocketMQConfig.Spool
+}
 
-	//log.Debug("send rmq",zap.Any("msg", payload))
+func (r *rocketMQ) sendErrors() uint64 {
+	return atomic.LoadUint64(&r.errors)
+}
 
-	// payload, err := json.Marshal(msg)
-	// if err != nil {
-	// 	return err
-	// }
+func (r *rocketMQ) Health() error {
+	return r.lastErr.get()
+}
 
-	//for _, topic := range topics {
+func (r *rocketMQ) message(topic string, key string, payload []byte, msg *Elements, tag string) *primitive.Message {
 	rmsg := primitive.NewMessage(topic,
-		msg.Payload)
+		payload)
+	if key != "" {
+		rmsg.WithKeys([]string{key})
+	}
 	rmsg.WithProperty("clientId", msg.ClientID)
 	rmsg.WithProperty("topic", msg.Topic)
 	if conf.RunConfig.Broker.ID != "" {
@@ -102,16 +272,176 @@ func (r *rocketMQ) publish(topic string, key string, msg *Elements, tag string)
 	if tag != "" {
 		rmsg.WithTag(tag)
 	}
+	if r.rocketMQConfig.Orderly {
+		rmsg.WithShardingKey(msg.ClientID)
+	}
+	return rmsg
+}
+
+// properties rocketmq sets on each message it stores or redelivers
+var storeProperties = map[string]bool{
+	primitive.PropertyUniqueClientMessageIdKeyIndex: true,
+	primitive.PropertyMinOffset:                     true,
+	primitive.PropertyMaxOffset:                     true,
+	primitive.PropertyConsumeStartTime:              true,
+	primitive.PropertyRealTopic:                     true,
+	primitive.PropertyRealQueueId:                   true,
+	primitive.PropertyRetryTopic:                    true,
+	primitive.PropertyReconsumeTime:                 true,
+	primitive.PropertyMaxReconsumeTimes:             true,
+	primitive.PropertyDelayTimeLevel:                true,
+	primitive.PropertyOriginMessageId:               true,
+}
+
+// DeadLetter sends msg, a subscribed message the client didn't get, to the
+// dead letter topic. It keeps the tag, keys and properties of msg and adds
+// the reason and the id of msg.
+func (r *rocketMQ) DeadLetter(msg *primitive.MessageExt, reason string) error {
+	rmsg := primitive.NewMessage(r.rocketMQConfig.DeadLetterTopic, msg.Body)
+	for k, v := range msg.GetProperties() {
+		if !storeProperties[k] {
+			rmsg.WithProperty(k, v)
+		}
+	}
+	rmsg.WithProperty("reason", reason)
+	rmsg.WithProperty("originMsgId", msg.MsgId)
+	return r.publish(rmsg)
+}
 
-	// sync
+// publish sends rmsg and waits for rocketmq to have it
+func (r *rocketMQ) publish(rmsg *primitive.Message) error {
 	res, err := r.rocketMQProducer.SendSync(context.Background(), rmsg)
 	if err != nil {
 		log.Warn("send message error: %s\n", zap.Error(err))
+		r.lastErr.set(err)
+		return err
+	} else if res.Status != primitive.SendOK {
+		log.Warn("send message not ok", zap.String("result", res.String()))
+		err = fmt.Errorf("rocketmq send status %d", res.Status)
+		r.lastErr.set(err)
 		return err
-	} else {
-		log.Info("send message success: result=%s\n", zap.ByteString(res.MsgID, []byte(res.String())))
 	}
-	//}
+	return nil
+}
+
+// publishAsync queues rmsg to be sent in the background, it waits for room
+// when MaxInFlight messages are in flight already
+func (r *rocketMQ) publishAsync(rmsg *rmqMsg, clientID string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return errors.New("rocketmq producer closed")
+	}
 
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		t := time.NewTimer(5 * time.Second)
+		select {
+		case r.inFlight <- struct{}{}:
+			t.Stop()
+		case <-t.C:
+			r.lastErr.set(errInFlightFull)
+			return errInFlightFull
+		}
+	}
+
+	// there is room in the channels for every message in flight
+	if r.lanes == nil {
+		r.batches <- rmsg
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientID))
+	r.lanes[h.Sum32()%uint32(len(r.lanes))] <- rmsg
 	return nil
 }
+
+// batch gathers the async messages by topic, a batch is sent once full or
+// after BatchInterval
+func (r *rocketMQ) batch() {
+	defer r.senders.Done()
+	size := r.rocketMQConfig.BatchSize
+	if size <= 0 {
+		size = 32
+	}
+	interval := time.Duration(r.rocketMQConfig.BatchInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = 10 * time.Millisecond
+	}
+
+	pending := make(map[string][]*rmqMsg)
+	send := func(topic string) {
+		r.sendBatch(pending[topic])
+		delete(pending, topic)
+	}
+	sendAll := func() {
+		for topic := range pending {
+			send(topic)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-r.batches:
+			if !ok {
+				sendAll()
+				return
+			}
+			pending[m.Topic] = append(pending[m.Topic], m)
+			if len(pending[m.Topic]) >= size {
+				send(m.Topic)
+			}
+		case <-ticker.C:
+			sendAll()
+		case done := <-r.flush:
+			sendAll()
+			close(done)
+		}
+	}
+}
+
+func (r *rocketMQ) sendBatch(msgs []*rmqMsg) {
+	batch := make([]*primitive.Message, len(msgs))
+	for i, m := range msgs {
+		batch[i] = m.Message
+	}
+	err := r.rocketMQProducer.SendAsync(context.Background(), func(ctx context.Context, res *primitive.SendResult, err error) {
+		r.sent(msgs, res, err)
+	}, batch...)
+	if err != nil {
+		r.sent(msgs, nil, err)
+	}
+}
+
+// lane sends the orderly messages of its clients one by one
+func (r *rocketMQ) lane(msgs chan *rmqMsg) {
+	defer r.senders.Done()
+	for m := range msgs {
+		res, err := r.rocketMQProducer.SendSync(context.Background(), m.Message)
+		r.sent([]*rmqMsg{m}, res, err)
+	}
+}
+
+// sent counts the async messages of a send that failed and hands them to
+// failed, then frees their room
+func (r *rocketMQ) sent(msgs []*rmqMsg, res *primitive.SendResult, err error) {
+	if err == nil && res.Status != primitive.SendOK {
+		err = fmt.Errorf("rocketmq send status %d", res.Status)
+	}
+	if err != nil {
+		atomic.AddUint64(&r.errors, uint64(len(msgs)))
+		r.lastErr.set(err)
+		log.Warn("send messages to rocketmq failed", zap.String("rocketmq", r.rocketMQConfig.Name), zap.Int("messages", len(msgs)), zap.Error(err))
+		for _, m := range msgs {
+			if m.async != nil {
+				r.failed(&m.async.rule, m.async.key, &m.async.msg)
+			}
+		}
+	}
+	for range msgs {
+		<-r.inFlight
+	}
+}
@@ -0,0 +1,401 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Message is what statements and templates are evaluated on
+type Message struct {
+	ClientID  string
+	Username  string
+	Topic     string
+	Payload   []byte
+	Qos       byte
+	Timestamp int64
+
+	levels []string
+}
+
+func (m *Message) level(i int) (string, bool) {
+	if m.levels == nil {
+		m.levels = strings.Split(m.Topic, "/")
+	}
+	if i >= len(m.levels) {
+		return "", false
+	}
+	return m.levels[i], true
+}
+
+// Values are nil, bool, int64, float64, string or json.RawMessage, for a
+// JSON object or array of the payload. Integers stay int64 as long as the
+// operations on them do, a nanosecond timestamp doesn't fit a float64.
+type expr interface {
+	eval(m *Message) interface{}
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l *literal) eval(m *Message) interface{} {
+	return l.v
+}
+
+type field struct {
+	root string
+	// level of topic[n], -1 for the whole topic
+	index int
+	// gjson path of payload.path
+	path string
+}
+
+// name is the one of a selected field without AS
+func (f *field) name() string {
+	if f.path != "" {
+		return f.path[strings.LastIndex(f.path, ".")+1:]
+	}
+	return f.root
+}
+
+func (f *field) eval(m *Message) interface{} {
+	switch f.root {
+	case "clientid":
+		return m.ClientID
+	case "username":
+		return m.Username
+	case "qos":
+		return int64(m.Qos)
+	case "timestamp":
+		return m.Timestamp
+	case "topic":
+		if f.index < 0 {
+			return m.Topic
+		}
+		if l, ok := m.level(f.index); ok {
+			return l
+		}
+		return nil
+	case "payload":
+		if f.path == "" {
+			return string(m.Payload)
+		}
+		return jsonValue(gjson.GetBytes(m.Payload, f.path))
+	}
+	return nil
+}
+
+func jsonValue(r gjson.Result) interface{} {
+	switch r.Type {
+	case gjson.False:
+		return false
+	case gjson.True:
+		return true
+	case gjson.Number:
+		if i, err := strconv.ParseInt(r.Raw, 10, 64); err == nil {
+			return i
+		}
+		return r.Num
+	case gjson.String:
+		return r.Str
+	case gjson.JSON:
+		return json.RawMessage(r.Raw)
+	}
+	return nil
+}
+
+type unary struct {
+	op string
+	x  expr
+}
+
+func (u *unary) eval(m *Message) interface{} {
+	v := u.x.eval(m)
+	switch u.op {
+	case "NOT":
+		b, ok := v.(bool)
+		if !ok {
+			return nil
+		}
+		return !b
+	case "-":
+		switch n := v.(type) {
+		case int64:
+			return -n
+		case float64:
+			return -n
+		}
+	}
+	return nil
+}
+
+type binary struct {
+	op   string
+	x, y expr
+}
+
+func (b *binary) eval(m *Message) interface{} {
+	switch b.op {
+	case "AND":
+		return truth(b.x.eval(m)) && truth(b.y.eval(m))
+	case "OR":
+		return truth(b.x.eval(m)) || truth(b.y.eval(m))
+	}
+
+	x, y := b.x.eval(m), b.y.eval(m)
+	switch b.op {
+	case "=":
+		return equal(x, y)
+	case "!=":
+		if x == nil || y == nil {
+			return false
+		}
+		return !equal(x, y)
+	case "<", "<=", ">", ">=":
+		c, ok := compare(x, y)
+		if !ok {
+			return false
+		}
+		switch b.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}
+
+	if s, ok := x.(string); ok && b.op == "+" {
+		if t, ok := y.(string); ok {
+			return s + t
+		}
+	}
+	if ix, ok := x.(int64); ok {
+		if iy, ok := y.(int64); ok {
+			return intOp(b.op, ix, iy)
+		}
+	}
+	fx, ok1 := float(x)
+	fy, ok2 := float(y)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	switch b.op {
+	case "+":
+		return fx + fy
+	case "-":
+		return fx - fy
+	case "*":
+		return fx * fy
+	case "/":
+		if fy == 0 {
+			return nil
+		}
+		return fx / fy
+	case "%":
+		if fy == 0 {
+			return nil
+		}
+		return math.Mod(fx, fy)
+	}
+	return nil
+}
+
+// intOp is op on two integers, a division is exact or gives a float as
+// with floats
+func intOp(op string, x, y int64) interface{} {
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		if y == 0 {
+			return nil
+		}
+		if x%y == 0 {
+			return x / y
+		}
+		return float64(x) / float64(y)
+	case "%":
+		if y == 0 {
+			return nil
+		}
+		return x % y
+	}
+	return nil
+}
+
+// float is the number v as a float64
+func float(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+type inList struct {
+	x    expr
+	list []expr
+	not  bool
+}
+
+func (in *inList) eval(m *Message) interface{} {
+	v := in.x.eval(m)
+	if v == nil {
+		return false
+	}
+	for _, y := range in.list {
+		if equal(v, y.eval(m)) {
+			return !in.not
+		}
+	}
+	return in.not
+}
+
+type isNull struct {
+	x   expr
+	not bool
+}
+
+func (n *isNull) eval(m *Message) interface{} {
+	return (n.x.eval(m) == nil) != n.not
+}
+
+func truth(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// equal compares values of the same type, numbers whatever their type,
+// null equals nothing
+func equal(x, y interface{}) bool {
+	switch a := x.(type) {
+	case bool:
+		b, ok := y.(bool)
+		return ok && a == b
+	case int64, float64:
+		c, ok := compare(a, y)
+		return ok && c == 0
+	case string:
+		b, ok := y.(string)
+		return ok && a == b
+	case json.RawMessage:
+		b, ok := y.(json.RawMessage)
+		return ok && bytes.Equal(a, b)
+	}
+	return false
+}
+
+// compare orders two numbers or two strings
+func compare(x, y interface{}) (int, bool) {
+	switch a := x.(type) {
+	case int64:
+		if b, ok := y.(int64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+		return compare(float64(a), y)
+	case float64:
+		b, ok := float(y)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := y.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// Eval tells whether m passes the where condition, and returns the JSON
+// object of the selected fields, nil for SELECT *. The topic filters are
+// left to the caller.
+func (s *Statement) Eval(m *Message) ([]byte, bool) {
+	if s.where != nil && !truth(s.where.eval(m)) {
+		return nil, false
+	}
+	if s.columns == nil {
+		return nil, true
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, c := range s.columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(c.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		writeJSON(&buf, c.x.eval(m))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), true
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			buf.WriteString("null")
+			return
+		}
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	case json.RawMessage:
+		buf.Write(v)
+	default:
+		buf.WriteString("null")
+	}
+}
+
+// text is v in a template
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package rule
+
+import (
+	"testing"
+)
+
+var evalMsg = Message{
+	ClientID:  "dev1",
+	Username:  "alice",
+	Topic:     "sensors/lab/temp",
+	Payload:   []byte(`{"temp":31.5,"count":3,"id":9007199254740993,"tags":["a","b"],"on":true,"name":"x"}`),
+	Qos:       1,
+	Timestamp: 1700000000123456789,
+}
+
+func TestWhere(t *testing.T) {
+	tests := []struct {
+		where string
+		want  bool
+	}{
+		{"payload.temp > 30", true},
+		{"payload.temp > 30 AND topic[1] = 'lab'", true},
+		{"payload.temp > 40 OR clientid = 'dev1'", true},
+		{"NOT payload.on", false},
+		{"qos IN (1, 2)", true},
+		{"qos NOT IN (1, 2)", false},
+		{"username IN ('bob')", false},
+		{"payload.missing IS NULL", true},
+		{"payload.name IS NOT NULL", true},
+		// null compares to nothing
+		{"payload.missing = NULL", false},
+		{"payload.missing != 1", false},
+		{"topic[5] = ''", false},
+		{"topic = 'sensors/lab/temp'", true},
+		{"topic[0] <> 'meters'", true},
+		// numbers of any type compare by value
+		{"payload.count = 3.0", true},
+		{"payload.count + 0.5 = 3.5", true},
+		{"payload.count % 2 = 1", true},
+		{"payload.count / 2 = 1.5", true},
+		{"payload.count * 2 = 6", true},
+		{"-payload.count < -2", true},
+		{"payload.count / 0 IS NULL", true},
+		// a number and a string are neither equal nor ordered
+		{"payload.count = '3'", false},
+		{"payload.count < 'a'", false},
+		{"payload.name + 'y' = 'xy'", true},
+		{"'b' > 'a'", true},
+		// integers keep their precision
+		{"timestamp = 1700000000123456789", true},
+		{"timestamp > 1700000000123456788", true},
+		{"payload.id = 9007199254740993", true},
+		{"payload.id = 9007199254740992", false},
+		{"payload.tags = payload.tags", true},
+		{"payload.on = TRUE AND FALSE = FALSE", true},
+		// a non bool condition is false
+		{"payload.count", false},
+	}
+	for _, tt := range tests {
+		s, err := Parse(`SELECT * FROM "#" WHERE ` + tt.where)
+		if err != nil {
+			t.Errorf("%s: %v", tt.where, err)
+			continue
+		}
+		m := evalMsg
+		if _, got := s.Eval(&m); got != tt.want {
+			t.Errorf("WHERE %s = %v, want %v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{`SELECT * FROM "#"`, ""},
+		{`SELECT clientid, qos, timestamp FROM "#"`,
+			`{"clientid":"dev1","qos":1,"timestamp":1700000000123456789}`},
+		{`SELECT payload.temp AS t, payload.tags, payload.missing AS m, topic[1] AS room FROM "#"`,
+			`{"t":31.5,"tags":["a","b"],"m":null,"room":"lab"}`},
+		{`SELECT timestamp / 1000000 AS ms, payload.count / 2 AS half, payload.id FROM "#"`,
+			`{"ms":1700000000123.4568,"half":1.5,"id":9007199254740993}`},
+		{`SELECT timestamp - timestamp % 1000000000 AS s, payload.on AS "on" FROM "#"`,
+			`{"s":1700000000000000000,"on":true}`},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.sql)
+		if err != nil {
+			t.Errorf("%s: %v", tt.sql, err)
+			continue
+		}
+		m := evalMsg
+		got, ok := s.Eval(&m)
+		if !ok || string(got) != tt.want {
+			t.Errorf("%s = %s, %v, want %s", tt.sql, got, ok, tt.want)
+		}
+	}
+}
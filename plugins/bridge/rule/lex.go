@@ -0,0 +1,100 @@
+package rule
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	// operators and punctuation, the text is in token.text
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// keywords are matched case insensitively, an identifier spelt as one is
+// the keyword
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AS": true,
+	"AND": true, "OR": true, "NOT": true, "IN": true, "IS": true,
+	"NULL": true, "TRUE": true, "FALSE": true,
+}
+
+// lex splits src into tokens
+func lex(src string) ([]token, error) {
+	var toks []token
+	r := []rune(src)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(r) && (r[j] == '_' || unicode.IsLetter(r[j]) || unicode.IsDigit(r[j])) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, string(r[i:j]), i})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(r) && unicode.IsDigit(r[j]) {
+				j++
+			}
+			if j+1 < len(r) && r[j] == '.' && unicode.IsDigit(r[j+1]) {
+				j++
+				for j < len(r) && unicode.IsDigit(r[j]) {
+					j++
+				}
+			}
+			toks = append(toks, token{tokNumber, string(r[i:j]), i})
+			i = j
+		case c == '\'' || c == '"':
+			// a quote is doubled to be part of the string
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(r) {
+					return nil, fmt.Errorf("unterminated string at %d", i)
+				}
+				if r[j] == c {
+					if j+1 < len(r) && r[j+1] == c {
+						b.WriteRune(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteRune(r[j])
+				j++
+			}
+			toks = append(toks, token{tokString, b.String(), i})
+			i = j + 1
+		default:
+			op := string(c)
+			if i+1 < len(r) {
+				switch two := string(r[i : i+2]); two {
+				case "!=", "<>", "<=", ">=":
+					op = two
+				}
+			}
+			if !strings.Contains("=!<>+-*/%(),.[]", op[:1]) || op == "!" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(r)}), nil
+}
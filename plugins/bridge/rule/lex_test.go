@@ -0,0 +1,42 @@
+package rule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []token
+	}{
+		{"SELECT *", []token{{tokIdent, "SELECT", 0}, {tokOp, "*", 7}, {tokEOF, "", 8}}},
+		{"a_1 >= 2.5", []token{{tokIdent, "a_1", 0}, {tokOp, ">=", 4}, {tokNumber, "2.5", 7}, {tokEOF, "", 10}}},
+		// a dot not followed by a digit ends the number
+		{"1.x", []token{{tokNumber, "1", 0}, {tokOp, ".", 1}, {tokIdent, "x", 2}, {tokEOF, "", 3}}},
+		{"x<>y!=z", []token{{tokIdent, "x", 0}, {tokOp, "<>", 1}, {tokIdent, "y", 3}, {tokOp, "!=", 4}, {tokIdent, "z", 6}, {tokEOF, "", 7}}},
+		// a doubled quote is part of the string
+		{`'it''s' "a/#"`, []token{{tokString, "it's", 0}, {tokString, "a/#", 8}, {tokEOF, "", 13}}},
+		{"topic[0]", []token{{tokIdent, "topic", 0}, {tokOp, "[", 5}, {tokNumber, "0", 6}, {tokOp, "]", 7}, {tokEOF, "", 8}}},
+		// positions count runes
+		{"'é' x", []token{{tokString, "é", 0}, {tokIdent, "x", 4}, {tokEOF, "", 5}}},
+	}
+	for _, tt := range tests {
+		got, err := lex(tt.src)
+		if err != nil {
+			t.Errorf("lex(%q): %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lex(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	for _, src := range []string{"'open", `"open''`, "a ! b", "a & b", "a;"} {
+		if toks, err := lex(src); err == nil {
+			t.Errorf("lex(%q) = %v, want an error", src, toks)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Package rule is the sql of the deliver rules and the templates of their
+// target topic, key and tag.
+//
+// A statement picks the messages of its topic filters that pass the where
+// condition, and makes their payload the JSON object of the selected fields:
+//
+//	SELECT payload.temp AS t, clientid FROM "sensors/#", "meters/#"
+//	WHERE payload.temp > 30 AND topic[1] = 'lab'
+//
+// SELECT * keeps the payload. A field is clientid, username, topic, topic[n]
+// (level n, from 0), qos, timestamp, payload (as text) or payload.path, a
+// gjson path into a JSON payload. Conditions have = != <> < <= > >=, AND, OR,
+// NOT, IN (...), IS [NOT] NULL and + - * / % on numbers, strings are in
+// single or double quotes.
+//
+// A template is text with ${field} in it, any expression of a statement goes
+// between the braces: "${topic[0]}-telemetry", "${payload.deviceId}".
+package rule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Statement is a parsed sql statement
+type Statement struct {
+	// nil for SELECT *
+	columns []column
+	filters []string
+	where   expr
+}
+
+type column struct {
+	name string
+	x    expr
+}
+
+// Parse parses a statement
+func Parse(sql string) (*Statement, error) {
+	toks, err := lex(sql)
+	if err != nil {
+		return nil, fmt.Errorf("sql %q: %v", sql, err)
+	}
+	p := &parser{toks: toks}
+	s, err := p.statement()
+	if err != nil {
+		return nil, fmt.Errorf("sql %q: %v", sql, err)
+	}
+	return s, nil
+}
+
+// Filters are the topic filters of the FROM clause
+func (s *Statement) Filters() []string {
+	return s.filters
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword tells whether t is keyword kw
+func isKeyword(t token, kw string) bool {
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+// accept takes the next token if it is keyword or operator s
+func (p *parser) accept(s string) bool {
+	t := p.peek()
+	if (t.kind == tokOp && t.text == s) || (keywords[s] && isKeyword(t, s)) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) statement() (*Statement, error) {
+	s := &Statement{}
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if !p.accept("*") {
+		for {
+			c, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			s.columns = append(s.columns, c)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	for {
+		t := p.next()
+		if t.kind != tokString || t.text == "" {
+			return nil, fmt.Errorf("FROM takes quoted topic filters, at %d", t.pos)
+		}
+		s.filters = append(s.filters, t.text)
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if p.accept("WHERE") {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		s.where = x
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return s, nil
+}
+
+// column is a selected expression, named by AS or after the last element
+// of its field
+func (p *parser) column() (column, error) {
+	x, err := p.expr()
+	if err != nil {
+		return column{}, err
+	}
+	c := column{x: x}
+	if p.accept("AS") {
+		t := p.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return column{}, fmt.Errorf("AS takes a name, at %d", t.pos)
+		}
+		c.name = t.text
+	} else if f, ok := x.(*field); ok {
+		c.name = f.name()
+	} else {
+		return column{}, fmt.Errorf("a selected expression needs AS, at %d", p.peek().pos)
+	}
+	return c, nil
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.or()
+}
+
+func (p *parser) or() (expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: "OR", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) and() (expr, error) {
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		y, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: "AND", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) not() (expr, error) {
+	if p.accept("NOT") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: "NOT", x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	x, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "=" || t.text == "!=" || t.text == "<>" ||
+		t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		y, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "<>" {
+			op = "!="
+		}
+		return &binary{op: op, x: x, y: y}, nil
+	case isKeyword(t, "IS"):
+		p.next()
+		not := p.accept("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		return &isNull{x: x, not: not}, nil
+	case isKeyword(t, "IN") || isKeyword(t, "NOT"):
+		p.next()
+		not := isKeyword(t, "NOT")
+		if not {
+			if err := p.expect("IN"); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		in := &inList{x: x, not: not}
+		for {
+			y, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, y)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}
+	return x, nil
+}
+
+func (p *parser) additive() (expr, error) {
+	x, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) multiplicative() (expr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.accept("-") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: "-", x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literal{v: i}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", t.text, t.pos)
+		}
+		return &literal{v: f}, nil
+	case tokString:
+		return &literal{v: t.text}, nil
+	case tokOp:
+		if t.text == "(" {
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		}
+	case tokIdent:
+		switch {
+		case isKeyword(t, "NULL"):
+			return &literal{v: nil}, nil
+		case isKeyword(t, "TRUE"):
+			return &literal{v: true}, nil
+		case isKeyword(t, "FALSE"):
+			return &literal{v: false}, nil
+		}
+		return p.field(t)
+	}
+	if t.kind != tokEOF {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
+
+// field parses the field starting with identifier t
+func (p *parser) field(t token) (expr, error) {
+	f := &field{root: strings.ToLower(t.text), index: -1}
+	switch f.root {
+	case "clientid", "username", "qos", "timestamp":
+		return f, nil
+	case "topic":
+		if p.accept("[") {
+			n := p.next()
+			i, err := strconv.Atoi(n.text)
+			if n.kind != tokNumber || err != nil || i < 0 {
+				return nil, fmt.Errorf("topic takes a level number, at %d", n.pos)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			f.index = i
+		}
+		return f, nil
+	case "payload":
+		var path []string
+		for {
+			if p.accept(".") {
+				n := p.next()
+				if n.kind != tokIdent && n.kind != tokNumber {
+					return nil, fmt.Errorf("bad payload path at %d", n.pos)
+				}
+				// a.0.1 lexes 0.1 as a number
+				path = append(path, strings.Split(n.text, ".")...)
+			} else if p.accept("[") {
+				n := p.next()
+				if _, err := strconv.Atoi(n.text); n.kind != tokNumber || err != nil {
+					return nil, fmt.Errorf("bad payload index at %d", n.pos)
+				}
+				if err := p.expect("]"); err != nil {
+					return nil, err
+				}
+				path = append(path, n.text)
+			} else {
+				break
+			}
+		}
+		f.path = strings.Join(path, ".")
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown field %q at %d", t.text, t.pos)
+}
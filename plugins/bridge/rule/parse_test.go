@@ -0,0 +1,73 @@
+package rule
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		sql     string
+		columns []string
+		filters []string
+	}{
+		{`SELECT * FROM "a/#"`, nil, []string{"a/#"}},
+		{`select clientid, payload.temp from 'a/+', "b/#"`, []string{"clientid", "temp"}, []string{"a/+", "b/#"}},
+		{`SELECT payload.a.b[1] AS x, topic[2] AS "level" FROM "t"`, []string{"x", "level"}, []string{"t"}},
+		{`SELECT qos * 2 AS q FROM "t" WHERE NOT qos IN (0, 1) OR username IS NOT NULL`, []string{"q"}, []string{"t"}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.sql)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.sql, err)
+			continue
+		}
+		var columns []string
+		for _, c := range s.columns {
+			columns = append(columns, c.name)
+		}
+		if !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("Parse(%q) columns %v, want %v", tt.sql, columns, tt.columns)
+		}
+		if !reflect.DeepEqual(s.Filters(), tt.filters) {
+			t.Errorf("Parse(%q) filters %v, want %v", tt.sql, s.Filters(), tt.filters)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		sql string
+		err string
+	}{
+		{`FROM "a"`, `unexpected "FROM" at 0`},
+		{`SELECT *`, "unexpected end"},
+		{`SELECT * FROM a`, "FROM takes quoted topic filters, at 14"},
+		{`SELECT * FROM ""`, "FROM takes quoted topic filters"},
+		{`SELECT qos + 1 FROM "a"`, "a selected expression needs AS"},
+		{`SELECT qos AS 1 FROM "a"`, "AS takes a name"},
+		{`SELECT foo FROM "a"`, `unknown field "foo" at 7`},
+		{`SELECT topic[x] AS t FROM "a"`, "topic takes a level number"},
+		{`SELECT topic[-1] AS t FROM "a"`, "topic takes a level number"},
+		{`SELECT payload.+ AS p FROM "a"`, "bad payload path"},
+		{`SELECT payload[a] AS p FROM "a"`, "bad payload index"},
+		{`SELECT * FROM "a" WHERE`, "unexpected end"},
+		{`SELECT * FROM "a" WHERE (qos = 1`, "unexpected end"},
+		{`SELECT * FROM "a" WHERE qos IS 1`, `unexpected "1"`},
+		{`SELECT * FROM "a" WHERE qos NOT (1)`, `unexpected "("`},
+		{`SELECT * FROM "a" WHERE qos IN 1`, `unexpected "1"`},
+		{`SELECT * FROM "a" qos`, `unexpected "qos"`},
+		{`SELECT * FROM "a" WHERE 'open`, "unterminated string"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.sql)
+		if err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", tt.sql, s)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) error %q, want %q", tt.sql, err, tt.err)
+		}
+	}
+}
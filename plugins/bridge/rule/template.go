@@ -0,0 +1,81 @@
+package rule
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a text with ${field} parts taken from the message
+type Template struct {
+	parts []part
+}
+
+// part is a literal text, or the expression of a ${...}
+type part struct {
+	text string
+	x    expr
+}
+
+// ParseTemplate parses text, a $ not followed by { is kept as it is
+func ParseTemplate(src string) (*Template, error) {
+	t := &Template{}
+	rest := src
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(rest[i:], "}")
+		if j < 0 {
+			return nil, fmt.Errorf("template %q: unclosed ${", src)
+		}
+		if i > 0 {
+			t.parts = append(t.parts, part{text: rest[:i]})
+		}
+
+		toks, err := lex(rest[i+2 : i+j])
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %v", src, err)
+		}
+		p := &parser{toks: toks}
+		x, err := p.expr()
+		if err == nil && p.peek().kind != tokEOF {
+			err = p.unexpected()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %v", src, err)
+		}
+		t.parts = append(t.parts, part{x: x})
+		rest = rest[i+j+1:]
+	}
+	if rest != "" {
+		t.parts = append(t.parts, part{text: rest})
+	}
+	return t, nil
+}
+
+// Static tells whether the template has no ${...}
+func (t *Template) Static() bool {
+	for _, p := range t.parts {
+		if p.x != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Render fills the template with the fields of m, a missing one is empty
+func (t *Template) Render(m *Message) string {
+	if len(t.parts) == 1 && t.parts[0].x == nil {
+		return t.parts[0].text
+	}
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.x == nil {
+			b.WriteString(p.text)
+		} else {
+			b.WriteString(text(p.x.eval(m)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		src    string
+		want   string
+		static bool
+	}{
+		{"plain", "plain", true},
+		{"", "", true},
+		{"$5 and $x", "$5 and $x", true},
+		{"${topic[0]}-telemetry", "sensors-telemetry", false},
+		{"${clientid}/${payload.name}/${qos}", "dev1/x/1", false},
+		{"${timestamp}", "1700000000123456789", false},
+		{"${payload.id}", "9007199254740993", false},
+		{"${payload.temp * 2}", "63", false},
+		{"${payload.tags}", `["a","b"]`, false},
+		{"${payload.missing}-${topic[9]}", "-", false},
+		{"${payload.on}", "true", false},
+	}
+	for _, tt := range tests {
+		tp, err := ParseTemplate(tt.src)
+		if err != nil {
+			t.Errorf("ParseTemplate(%q): %v", tt.src, err)
+			continue
+		}
+		if tp.Static() != tt.static {
+			t.Errorf("%q static %v", tt.src, tp.Static())
+		}
+		m := evalMsg
+		if got := tp.Render(&m); got != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"${clientid", "unclosed ${"},
+		{"${}", "unexpected end"},
+		{"${clientid qos}", `unexpected "qos"`},
+		{"${foo}", `unknown field "foo"`},
+		{"${'open}", "unterminated string"},
+	}
+	for _, tt := range tests {
+		tp, err := ParseTemplate(tt.src)
+		if err == nil {
+			t.Errorf("ParseTemplate(%q) = %+v, want an error", tt.src, tp)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseTemplate(%q) error %q, want %q", tt.src, err, tt.err)
+		}
+	}
+}
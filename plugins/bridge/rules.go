@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"errors"
+	"rocketmqtt/conf"
+	"rocketmqtt/plugins/bridge/rule"
+)
+
+// compiledRule is a deliver rule ready to apply: its sql if it has one,
+// and the templates of its target topic, tag and key
+type compiledRule struct {
+	// nil for a rule with a pattern
+	stmt  *rule.Statement
+	topic *rule.Template
+	tag   *rule.Template
+	key   *rule.Template
+	// static is true when no template has a ${...}, the rule is then sent
+	// as it is
+	static bool
+}
+
+func compileRule(dr *conf.DeliversRule) (*compiledRule, error) {
+	r := &compiledRule{}
+	var err error
+	if dr.Sql != "" {
+		if dr.Pattern != "" {
+			return nil, errors.New("a rule has either a pattern or an sql")
+		}
+		if r.stmt, err = rule.Parse(dr.Sql); err != nil {
+			return nil, err
+		}
+	}
+	if r.topic, err = rule.ParseTemplate(dr.Topic); err != nil {
+		return nil, err
+	}
+	if r.tag, err = rule.ParseTemplate(dr.Tag); err != nil {
+		return nil, err
+	}
+	if r.key, err = rule.ParseTemplate(dr.Key); err != nil {
+		return nil, err
+	}
+	r.static = r.topic.Static() && r.tag.Static() && r.key.Static()
+	return r, nil
+}
+
+// apply evaluates the rule on e. It returns the rule with its target topic
+// and tag filled in, the key and the message to send, whose payload is the
+// selected fields of an sql. ok is false when e doesn't pass the where
+// condition.
+func (r *compiledRule) apply(dr *conf.DeliversRule, e *Elements) (*conf.DeliversRule, string, *Elements, bool) {
+	if r.stmt == nil && r.static {
+		key := dr.Key
+		if key == "" {
+			key = e.ClientID
+		}
+		return dr, key, e, true
+	}
+
+	m := &rule.Message{
+		ClientID:  e.ClientID,
+		Username:  e.Username,
+		Topic:     e.Topic,
+		Payload:   e.Payload,
+		Qos:       e.Qos,
+		Timestamp: e.Timestamp,
+	}
+	msg := e
+	if r.stmt != nil {
+		payload, ok := r.stmt.Eval(m)
+		if !ok {
+			return nil, "", nil, false
+		}
+		if payload != nil {
+			cp := *e
+			cp.Payload = payload
+			cp.Size = int32(len(payload))
+			msg = &cp
+		}
+	}
+
+	rendered := dr
+	if !r.static {
+		cp := *dr
+		cp.Topic = r.topic.Render(m)
+		cp.Tag = r.tag.Render(m)
+		rendered = &cp
+	}
+	key := r.key.Render(m)
+	if dr.Key == "" {
+		key = e.ClientID
+	}
+	return rendered, key, msg, true
+}
@@ -0,0 +1,450 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rocketmqtt/conf"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSpoolSize = 1 << 30
+	defaultSpoolAge  = 24 * time.Hour
+	// longest wait between two replays of a target still down
+	maxSpoolRetry = 30 * time.Second
+	// records read, and removed once replayed, in one transaction
+	spoolReplayBatch = 100
+)
+
+var (
+	spoolBucket  = []byte("spool")
+	errSpoolFull = errors.New("spool is full")
+)
+
+// spoolTarget is a target with a spool config
+type spoolTarget interface {
+	spoolConfig() conf.Spool
+}
+
+// asyncTarget is a target whose writes may fail once Publish returned, it
+// hands them to the func it is given
+type asyncTarget interface {
+	onFailed(func(rule *conf.DeliversRule, key string, msg *Elements))
+}
+
+// spoolRecord is a message in the spool, with what its target needs to send
+// it again
+type spoolRecord struct {
+	Rule conf.DeliversRule `json:"rule"`
+	Key  string            `json:"key"`
+	Msg  *Elements         `json:"msg"`
+	// when the message was spooled, in unix nanoseconds
+	At int64 `json:"at"`
+}
+
+// SpoolStats are the figures of the spool of a target
+type SpoolStats struct {
+	Target   string
+	Messages int64
+	Bytes    int64
+	Spooled  uint64
+	Replayed uint64
+	Dropped  uint64
+}
+
+// spool wraps a target with a file the messages go to once the target
+// fails to take one, until the spool is empty again. Messages are replayed
+// in order, each one confirmed by the target. Confirmed writes never go to
+// the spool, their ack waits for the target itself. The messages are
+// written to the file in the background, the ones waiting in one
+// transaction.
+type spool struct {
+	Target
+	name    string
+	db      *bolt.DB
+	maxSize int64
+	maxAge  time.Duration
+
+	mu   sync.Mutex
+	down bool
+	// messages and bytes count the pending records too
+	messages int64
+	bytes    int64
+	// records pushed and not written yet
+	pending [][]byte
+
+	spooled  uint64
+	replayed uint64
+	dropped  uint64
+
+	wake  chan struct{}
+	flush chan struct{}
+	// quit stops the replay, stop the writer once the target is closed
+	quit    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	written chan struct{}
+}
+
+func newSpool(name string, t Target, cfg conf.Spool) (*spool, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = filepath.Join(conf.RunConfig.Store.DataDir(), "spool")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, name+".db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open spool of %s: %v", name, err)
+	}
+
+	s := &spool{
+		Target:  t,
+		name:    name,
+		db:      db,
+		maxSize: cfg.MaxSize,
+		maxAge:  time.Duration(cfg.MaxAge) * time.Second,
+		wake:    make(chan struct{}, 1),
+		flush:   make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		written: make(chan struct{}),
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultSpoolSize
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultSpoolAge
+	}
+
+	// messages left by the last run are replayed first
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(spoolBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.messages++
+			s.bytes += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open spool of %s: %v", name, err)
+	}
+	s.down = s.messages > 0
+
+	if at, ok := t.(asyncTarget); ok {
+		at.onFailed(s.failed)
+	}
+	go s.writer()
+	go s.run()
+	return s, nil
+}
+
+func (s *spool) Publish(rule *conf.DeliversRule, key string, msg *Elements) error {
+	if rule.Confirm {
+		return s.Target.Publish(rule, key, msg)
+	}
+
+	s.mu.Lock()
+	down := s.down
+	s.mu.Unlock()
+
+	if !down {
+		err := s.Target.Publish(rule, key, msg)
+		if err == nil {
+			return nil
+		}
+		log.Warn("target down, spool its messages", zap.String("target", s.name), zap.Error(err))
+		s.mu.Lock()
+		s.down = true
+		s.mu.Unlock()
+	}
+	return s.push(rule, key, msg)
+}
+
+// failed spools a message the target took but failed to write
+func (s *spool) failed(rule *conf.DeliversRule, key string, msg *Elements) {
+	s.mu.Lock()
+	s.down = true
+	s.mu.Unlock()
+	if err := s.push(rule, key, msg); err != nil {
+		log.Warn("spool failed message error", zap.String("target", s.name), zap.Error(err))
+	}
+}
+
+func (s *spool) push(rule *conf.DeliversRule, key string, msg *Elements) error {
+	v, err := json.Marshal(&spoolRecord{Rule: *rule, Key: key, Msg: msg, At: time.Now().UnixNano()})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.bytes+int64(len(v)) > s.maxSize {
+		s.mu.Unlock()
+		atomic.AddUint64(&s.dropped, 1)
+		return errSpoolFull
+	}
+	s.pending = append(s.pending, v)
+	s.messages++
+	s.bytes += int64(len(v))
+	s.mu.Unlock()
+	atomic.AddUint64(&s.spooled, 1)
+
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writer writes the pushed records to the file until the spool is closed
+func (s *spool) writer() {
+	defer close(s.written)
+	for {
+		select {
+		case <-s.flush:
+			s.write()
+		case <-s.stop:
+			s.write()
+			return
+		}
+	}
+}
+
+// write appends the pending records to the file in one transaction, and
+// wakes the replay up
+func (s *spool) write() {
+	s.mu.Lock()
+	records := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spoolBucket)
+		for _, v := range records {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("write spool error", zap.String("target", s.name), zap.Int("count", len(records)), zap.Error(err))
+		var size int64
+		for _, v := range records {
+			size += int64(len(v))
+		}
+		s.mu.Lock()
+		s.messages -= int64(len(records))
+		s.bytes -= size
+		s.mu.Unlock()
+		atomic.AddUint64(&s.dropped, uint64(len(records)))
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run replays the spool whenever a message comes in, and again and again
+// while the target is down
+func (s *spool) run() {
+	defer close(s.done)
+
+	retry := time.Second
+	timer := time.NewTimer(retry)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+
+		if s.replay() {
+			retry = time.Second
+		} else if retry *= 2; retry > maxSpoolRetry {
+			retry = maxSpoolRetry
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(retry)
+	}
+}
+
+// spoolEntry is a record read from the file
+type spoolEntry struct {
+	k, v []byte
+}
+
+// replay sends the spooled messages in order until the spool is empty, or
+// the target fails again
+func (s *spool) replay() bool {
+	for {
+		entries := s.next(spoolReplayBatch)
+		if len(entries) == 0 {
+			s.mu.Lock()
+			if s.messages == 0 {
+				s.down = false
+			}
+			s.mu.Unlock()
+			return true
+		}
+
+		// the records replayed or dropped go in one transaction, when the
+		// batch is done or the target fails
+		var replayed, dropped []spoolEntry
+		ok := true
+		for _, e := range entries {
+			select {
+			case <-s.quit:
+				ok = false
+			default:
+			}
+			if !ok {
+				break
+			}
+
+			var r spoolRecord
+			if err := json.Unmarshal(e.v, &r); err != nil || r.Msg == nil {
+				log.Error("drop bad spool record", zap.String("target", s.name), zap.Error(err))
+				dropped = append(dropped, e)
+				continue
+			}
+			if time.Since(time.Unix(0, r.At)) > s.maxAge {
+				dropped = append(dropped, e)
+				continue
+			}
+
+			r.Rule.Confirm = true
+			if err := s.Target.Publish(&r.Rule, r.Key, r.Msg); err != nil {
+				log.Debug("replay spool failed", zap.String("target", s.name), zap.Error(err))
+				ok = false
+				break
+			}
+			replayed = append(replayed, e)
+		}
+		s.remove(replayed, &s.replayed)
+		s.remove(dropped, &s.dropped)
+		if !ok {
+			return false
+		}
+	}
+}
+
+// next reads the n first records of the file
+func (s *spool) next(n int) []spoolEntry {
+	var entries []spoolEntry
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(spoolBucket).Cursor()
+		for k, v := c.First(); k != nil && len(entries) < n; k, v = c.Next() {
+			entries = append(entries, spoolEntry{
+				k: append([]byte(nil), k...),
+				v: append([]byte(nil), v...),
+			})
+		}
+		return nil
+	})
+	return entries
+}
+
+// remove takes entries out of the spool and counts them in counter
+func (s *spool) remove(entries []spoolEntry, counter *uint64) {
+	if len(entries) == 0 {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spoolBucket)
+		for _, e := range entries {
+			if err := b.Delete(e.k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("remove spool records error", zap.String("target", s.name), zap.Error(err))
+	}
+
+	var size int64
+	for _, e := range entries {
+		size += int64(len(e.v))
+	}
+	s.mu.Lock()
+	s.messages -= int64(len(entries))
+	s.bytes -= size
+	s.mu.Unlock()
+	atomic.AddUint64(counter, uint64(len(entries)))
+}
+
+// Health is the one of the target, or the messages waiting in the spool
+func (s *spool) Health() error {
+	if err := s.Target.Health(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return fmt.Errorf("target down, %d messages spooled", s.messages)
+	}
+	return nil
+}
+
+// Close stops the replay and closes the spool file, what it holds is
+// replayed on the next start
+// Close stops the replay and closes the target, the messages it fails to
+// send meanwhile are written before the file is closed.
+func (s *spool) Close() error {
+	close(s.quit)
+	<-s.done
+	err := s.Target.Close()
+	close(s.stop)
+	<-s.written
+	if err := s.db.Close(); err != nil {
+		log.Error("close spool error", zap.String("target", s.name), zap.Error(err))
+	}
+	return err
+}
+
+func (s *spool) stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SpoolStats{
+		Target:   s.name,
+		Messages: s.messages,
+		Bytes:    s.bytes,
+		Spooled:  atomic.LoadUint64(&s.spooled),
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+	}
+}
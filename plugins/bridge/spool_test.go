@@ -0,0 +1,87 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rocketmqtt/conf"
+)
+
+// TestSpoolKeepsFailedWebhookPosts checks the messages a webhook took and
+// then failed to post go to the spool, and reach the webhook once it's back.
+func TestSpoolKeepsFailedWebhookPosts(t *testing.T) {
+	var down int32 = 1
+	var mu sync.Mutex
+	got := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Elements
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		mu.Lock()
+		got[e.Topic] = true
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	w := &webhook{webhookConfig: conf.Webhook{Name: "hook", URL: srv.URL}}
+	if err := w.connect(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool("hook", w, conf.Spool{Enable: true, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rule := &conf.DeliversRule{Pattern: "#"}
+	const total = 3
+	for i := 0; i < total; i++ {
+		if err := s.Publish(rule, "", &Elements{Topic: fmt.Sprint("t/", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, "spooled posts", func() bool { return s.stats().Spooled >= total })
+
+	// back up, the replay needn't wait for its backoff
+	atomic.StoreInt32(&down, 0)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	waitUntil(t, "replayed posts", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == total
+	})
+	var topics []string
+	for topic := range got {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	if fmt.Sprint(topics) != "[t/0 t/1 t/2]" {
+		t.Fatalf("got %v", topics)
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
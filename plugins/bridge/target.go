@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"rocketmqtt/conf"
+)
+
+// names of the drivers of this package, as in the plugin of a deliver rule
+const (
+	Kafka    = "kafka"
+	Rocketmq = "rocketmq"
+	Webhook  = "webhook"
+)
+
+// healthWindow is how long an error of a target makes it unhealthy
+const healthWindow = time.Minute
+
+var drivers = make(map[string]Driver)
+
+// Target is a system the messages of the broker are bridged to, one entry of
+// a plugin section of the config.
+type Target interface {
+	// Publish sends msg as deliver rule rule says, key is the message key.
+	// With rule.Confirm, it returns once the write is confirmed.
+	Publish(rule *conf.DeliversRule, key string, msg *Elements) error
+	// Flush sends what the target may hold back
+	Flush() error
+	Close() error
+	// Health is the last error the target ran into, nil when it is fine
+	Health() error
+}
+
+// Driver opens the enabled targets of its plugin section, by name
+type Driver func() (map[string]Target, error)
+
+func Register(name string, driver Driver) {
+	if driver == nil {
+		log.Panic("bridge: Register driver is nil")
+	}
+
+	if _, dup := drivers[name]; dup {
+		log.Panic("bridge: Register called twice for driver " + name)
+	}
+
+	drivers[name] = driver
+}
+
+func Unregister(name string) {
+	delete(drivers, name)
+}
+
+// unwrap returns the target behind a spool
+func unwrap(t Target) Target {
+	if s, ok := t.(*spool); ok {
+		return s.Target
+	}
+	return t
+}
+
+// lastError keeps the last error of a target for its Health
+type lastError struct {
+	mu  sync.Mutex
+	err error
+	at  time.Time
+}
+
+func (l *lastError) set(err error) {
+	l.mu.Lock()
+	l.err, l.at = err, time.Now()
+	l.mu.Unlock()
+}
+
+// get returns the last error if it is recent enough
+func (l *lastError) get() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil || time.Since(l.at) > healthWindow {
+		return nil
+	}
+	return l.err
+}
@@ -0,0 +1,270 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"rocketmqtt/conf"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errQueueFull = errors.New("webhook queue is full")
+
+// maxWebhookRetry is the longest wait between two posts of a message
+const maxWebhookRetry = 30 * time.Second
+
+// webhookFuncs are the functions of a body template besides the builtins:
+// json quotes a value as JSON, string turns the payload bytes into text
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"string": func(b []byte) string {
+		return string(b)
+	},
+	"base64": func(b []byte) string {
+		return base64.StdEncoding.EncodeToString(b)
+	},
+}
+
+// webhookData is what a body template is executed with, the message and the
+// deliver rule it matched
+type webhookData struct {
+	*Elements
+	Rule *conf.DeliversRule
+}
+
+type webhook struct {
+	webhookConfig conf.Webhook
+	client        *http.Client
+	template      *template.Template
+	queue         chan webhookMsg
+	// pending counts the messages queued or being sent, for Flush
+	pending int64
+	workers sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+	lastErr lastError
+	// failed gets the queued messages the webhook failed to take, nil
+	// without a spool
+	failed func(rule *conf.DeliversRule, key string, msg *Elements)
+}
+
+// webhookMsg is a queued body, with what the spool needs to keep it when
+// the post fails
+type webhookMsg struct {
+	body  []byte
+	async *asyncMsg
+}
+
+func init() {
+	Register(Webhook, InitWebhook)
+}
+
+func InitWebhook() (map[string]Target, error) {
+	var hooks = make(map[string]Target)
+	for _, w := range conf.RunConfig.Plugins.Webhook {
+		if !w.Enable {
+			continue
+		}
+		c := &webhook{webhookConfig: w}
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+		hooks[w.Name] = c
+	}
+	return hooks, nil
+}
+
+func (w *webhook) connect() error {
+	cfg := &w.webhookConfig
+	if cfg.URL == "" {
+		return fmt.Errorf("webhook %s has no url", cfg.Name)
+	}
+	if cfg.Template != "" {
+		t, err := template.New(cfg.Name).Funcs(webhookFuncs).Parse(cfg.Template)
+		if err != nil {
+			return fmt.Errorf("webhook %s template error: %v", cfg.Name, err)
+		}
+		w.template = t
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5000
+	}
+	w.client = &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = 1000
+	}
+	w.queue = make(chan webhookMsg, size)
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		w.workers.Add(1)
+		go w.run()
+	}
+	return nil
+}
+
+// Publish renders the body of msg and queues it, it's sent in the background
+// unless it has to be confirmed
+func (w *webhook) Publish(rule *conf.DeliversRule, key string, msg *Elements) error {
+	body, err := w.render(rule, msg)
+	if err != nil {
+		return err
+	}
+	if rule.Confirm {
+		if err := w.send(body); err != nil {
+			w.lastErr.set(err)
+			return err
+		}
+		return nil
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return errors.New("webhook closed")
+	}
+
+	m := webhookMsg{body: body}
+	if w.failed != nil {
+		// a copy, msg goes back to its pool once Publish returns
+		m.async = &asyncMsg{rule: *rule, key: key, msg: *msg}
+	}
+	atomic.AddInt64(&w.pending, 1)
+	select {
+	case w.queue <- m:
+		return nil
+	default:
+		atomic.AddInt64(&w.pending, -1)
+		w.lastErr.set(errQueueFull)
+		return errQueueFull
+	}
+}
+
+// onFailed hands the queued messages the webhook fails to take to f
+func (w *webhook) onFailed(f func(rule *conf.DeliversRule, key string, msg *Elements)) {
+	w.failed = f
+}
+
+// render is done when the message is published, msg is reused afterwards
+func (w *webhook) render(rule *conf.DeliversRule, msg *Elements) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(msg)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, webhookData{Elements: msg, Rule: rule}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *webhook) run() {
+	defer w.workers.Done()
+	for m := range w.queue {
+		if err := w.send(m.body); err != nil {
+			log.Error("send msg to webhook failed: ", zap.String("webhook", w.webhookConfig.Name), zap.Error(err))
+			w.lastErr.set(err)
+			if m.async != nil {
+				w.failed(&m.async.rule, m.async.key, &m.async.msg)
+			}
+		}
+		atomic.AddInt64(&w.pending, -1)
+	}
+}
+
+// send posts body, retrying with a doubling wait, up to maxWebhookRetry, on
+// network errors, 5xx and 429 answers
+func (w *webhook) send(body []byte) error {
+	cfg := &w.webhookConfig
+	wait := time.Duration(cfg.RetryInterval) * time.Millisecond
+	if wait <= 0 {
+		wait = 500 * time.Millisecond
+	}
+
+	var err error
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = w.post(body)
+		if err == nil || !retry || i >= cfg.Retries {
+			return err
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWebhookRetry {
+			wait = maxWebhookRetry
+		}
+	}
+}
+
+func (w *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.webhookConfig.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.webhookConfig.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook answered %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Flush waits for the queued messages to be sent
+func (w *webhook) Flush() error {
+	for atomic.LoadInt64(&w.pending) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close sends the queued messages and stops the workers
+func (w *webhook) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	w.workers.Wait()
+	return nil
+}
+
+func (w *webhook) spoolConfig() conf.Spool {
+	return w.webhookConfig.Spool
+}
+
+func (w *webhook) Health() error {
+	return w.lastErr.get()
+}